@@ -0,0 +1,324 @@
+// Package admin implements a JSON API to inspect and control running pools.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/provider/types"
+)
+
+// API serves the following endpoints:
+//   - GET /api/workers: Lists active workers, along with their mirror, rank and throughput.
+//   - POST /api/evict?worker=<name>: Evicts a worker from the pool.
+//   - GET, POST and DELETE /api/pins?mirror=<url>: Lists, adds or removes mirrors that are never evicted for their
+//     performance.
+//   - GET, POST and DELETE /api/bans?mirror=<url>: Lists, adds or removes mirrors that are not allowed in the pool.
+//   - GET and DELETE /api/quarantine?mirror=<url>: Lists mirrors kept out of the pool after being evicted, or releases
+//     one of them.
+//   - GET /api/candidates: Lists all the mirrors the provider might feed to the pool, along with their metadata. Only
+//     some providers support this.
+//   - GET /api/mirrorlist?format=<format>: Renders the ranking as a mirrorlist for a package manager, see
+//     FormatPacman, FormatSourcesList and FormatPlain. For sources.list, suite and components can also be specified.
+//
+// All endpoints accept an optional route parameter to act only on the pool serving that route. Otherwise, they act on
+// all of them.
+type API struct {
+	pools   map[string]*pool.Pool
+	formats map[string]string
+	mux     *http.ServeMux
+}
+
+// New returns an API that controls the given pools, indexed by the name of the route they serve. formats contains the
+// default mirrorlist format for each route.
+func New(pools map[string]*pool.Pool, formats map[string]string) *API {
+	api := &API{
+		pools:   pools,
+		formats: formats,
+		mux:     http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc("/api/workers", api.workers)
+	api.mux.HandleFunc("/api/evict", api.evict)
+	api.mux.HandleFunc("/api/pins", api.pins)
+	api.mux.HandleFunc("/api/bans", api.bans)
+	api.mux.HandleFunc("/api/quarantine", api.quarantine)
+	api.mux.HandleFunc("/api/candidates", api.candidates)
+	api.mux.HandleFunc("/api/mirrorlist", api.mirrorlist)
+
+	return api
+}
+
+func (a *API) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(rw, r)
+}
+
+type workerView struct {
+	Route string `json:"route"`
+	pool.WorkerInfo
+	// Rank is the position of the worker in the ranking, starting at 1. It is 0 if the worker is not ranked yet.
+	Rank           int     `json:"rank"`
+	ThroughputMiBs float64 `json:"throughputMiBs"`
+	LatencyMs      int64   `json:"latencyMs"`
+	Samples        int     `json:"samples"`
+	Pinned         bool    `json:"pinned"`
+	// Metadata is what the provider knows about the mirror, if anything.
+	Metadata *types.Mirror `json:"metadata,omitempty"`
+}
+
+// selected returns the names of the routes selected by the route parameter of r, sorted alphabetically.
+func (a *API) selected(r *http.Request) ([]string, error) {
+	if route := r.URL.Query().Get("route"); route != "" {
+		if _, found := a.pools[route]; !found {
+			return nil, fmt.Errorf("unknown route %q", route)
+		}
+
+		return []string{route}, nil
+	}
+
+	routes := make([]string, 0, len(a.pools))
+	for route := range a.pools {
+		routes = append(routes, route)
+	}
+	slices.Sort(routes)
+
+	return routes, nil
+}
+
+func (a *API) workers(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	views := make([]workerView, 0)
+	for _, route := range routes {
+		p := a.pools[route]
+		st := p.Stats()
+		ranking := st.Ranking()
+
+		for _, info := range p.ActiveWorkers() {
+			view := workerView{
+				Route:      route,
+				WorkerInfo: info,
+				Pinned:     st.Pinned(info.Mirror),
+			}
+
+			if meta, found := st.Metadata(info.Mirror); found {
+				view.Metadata = &meta
+			}
+
+			for i, entry := range ranking {
+				if entry.Name != info.Name {
+					continue
+				}
+
+				view.Rank = i + 1
+				view.ThroughputMiBs = entry.Throughput / 1024 / 1024
+				view.LatencyMs = entry.Latency.Milliseconds()
+				view.Samples = entry.Samples
+				break
+			}
+
+			views = append(views, view)
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+type candidateView struct {
+	Route string `json:"route"`
+	types.Mirror
+}
+
+func (a *API) candidates(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	views := make([]candidateView, 0)
+	for _, route := range routes {
+		candidates, err := a.pools[route].Candidates(r.Context())
+		if err != nil {
+			writeError(rw, http.StatusBadGateway, fmt.Errorf("listing candidates for route %q: %w", route, err))
+			return
+		}
+
+		for _, candidate := range candidates {
+			views = append(views, candidateView{Route: route, Mirror: candidate})
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+func (a *API) evict(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("worker")
+	if name == "" {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("missing worker parameter"))
+		return
+	}
+
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	for _, route := range routes {
+		if a.pools[route].Evict(name) == nil {
+			log.Infof("Evicting worker %s as requested through the admin API", name)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	writeError(rw, http.StatusNotFound, fmt.Errorf("worker %q not found", name))
+}
+
+type quarantineView struct {
+	Route string `json:"route"`
+	pool.QuarantineInfo
+}
+
+func (a *API) quarantine(rw http.ResponseWriter, r *http.Request) {
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		views := make([]quarantineView, 0)
+		for _, route := range routes {
+			for _, info := range a.pools[route].Quarantined() {
+				views = append(views, quarantineView{Route: route, QuarantineInfo: info})
+			}
+		}
+
+		writeJSON(rw, http.StatusOK, views)
+	case http.MethodDelete:
+		mirror := r.URL.Query().Get("mirror")
+		if mirror == "" {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("missing mirror parameter"))
+			return
+		}
+
+		for _, route := range routes {
+			log.Infof("Releasing %s from quarantine of route %q as requested through the admin API", mirror, route)
+			a.pools[route].Release(mirror)
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) pins(rw http.ResponseWriter, r *http.Request) {
+	a.mirrorList(rw, r, func(p *pool.Pool) mirrorList {
+		st := p.Stats()
+		return mirrorList{list: st.Pins, add: st.Pin, remove: st.Unpin}
+	})
+}
+
+func (a *API) bans(rw http.ResponseWriter, r *http.Request) {
+	a.mirrorList(rw, r, func(p *pool.Pool) mirrorList {
+		return mirrorList{list: p.Bans, add: p.Ban, remove: p.Unban}
+	})
+}
+
+// mirrorList contains the functions to list, add and remove mirrors from a list kept by a pool.
+type mirrorList struct {
+	list        func() []string
+	add, remove func(string)
+}
+
+// mirrorList handles an endpoint that lists, adds and removes mirrors from a list in the selected pools.
+func (a *API) mirrorList(rw http.ResponseWriter, r *http.Request, listFor func(*pool.Pool) mirrorList) {
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		mirrors := make([]string, 0)
+		for _, route := range routes {
+			for _, mirror := range listFor(a.pools[route]).list() {
+				if !slices.Contains(mirrors, mirror) {
+					mirrors = append(mirrors, mirror)
+				}
+			}
+		}
+		slices.Sort(mirrors)
+
+		writeJSON(rw, http.StatusOK, mirrors)
+		return
+	}
+
+	mirror := r.URL.Query().Get("mirror")
+	if mirror == "" {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("missing mirror parameter"))
+		return
+	}
+
+	for _, route := range routes {
+		ml := listFor(a.pools[route])
+
+		switch r.Method {
+		case http.MethodPost:
+			log.Infof("Adding %s to %s of route %q as requested through the admin API", mirror, r.URL.Path, route)
+			ml.add(mirror)
+		case http.MethodDelete:
+			log.Infof("Removing %s from %s of route %q as requested through the admin API", mirror, r.URL.Path, route)
+			ml.remove(mirror)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	err := json.NewEncoder(rw).Encode(v)
+	if err != nil {
+		log.Warnf("Could not write admin API response: %v", err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, struct {
+		Error string `json:"error"`
+	}{
+		Error: err.Error(),
+	})
+}
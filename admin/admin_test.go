@@ -0,0 +1,200 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/admin"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/stats"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mibs returns a sample with a throughput of n MiB/s.
+func mibs(n float64) stats.Sample {
+	return stats.Sample{Bytes: int64(n * 1024 * 1024), Duration: time.Second}
+}
+
+// newPool returns a pool that is not running, whose ranking contains the given workers with the given throughputs.
+func newPool(name string, workers map[string]float64) *pool.Pool {
+	st := stats.New(stats.Config{})
+	for worker, throughput := range workers {
+		st.Update(worker, mibs(throughput))
+	}
+
+	return pool.New(pool.Config{Name: name}, st, nil)
+}
+
+func newAPI() *admin.API {
+	return admin.New(
+		map[string]*pool.Pool{
+			"arch": newPool("arch", map[string]float64{
+				"fast:https://fast.mirror/archlinux/":      30,
+				"slow:http://slow.mirror/archlinux/":       10,
+				"also-fast:https://fast.mirror/archlinux/": 20,
+			}),
+			"debian": newPool("debian", map[string]float64{
+				"deb:http://deb.mirror/debian/": 10,
+			}),
+		},
+		map[string]string{
+			"arch":   admin.FormatPacman,
+			"debian": admin.FormatSourcesList,
+		},
+	)
+}
+
+func do(api *admin.API, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+// lines returns the lines of body that are not empty nor comments.
+func lines(body string) []string {
+	var entries []string
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entries = append(entries, line)
+	}
+
+	return entries
+}
+
+func TestAPI_Renders_Mirrorlist(t *testing.T) {
+	t.Parallel()
+
+	api := newAPI()
+	for _, tc := range []struct {
+		name   string
+		target string
+		lines  []string
+	}{
+		{
+			name:   "default format of the route",
+			target: "/api/mirrorlist?route=arch",
+			lines: []string{
+				"Server = https://fast.mirror/archlinux/$repo/os/$arch",
+				"Server = http://slow.mirror/archlinux/$repo/os/$arch",
+			},
+		},
+		{
+			name:   "plain",
+			target: "/api/mirrorlist?route=arch&format=plain",
+			lines:  []string{"https://fast.mirror/archlinux/", "http://slow.mirror/archlinux/"},
+		},
+		{
+			name:   "sources.list with default suite and components",
+			target: "/api/mirrorlist?route=debian",
+			lines:  []string{"deb http://deb.mirror/debian/ stable main"},
+		},
+		{
+			name:   "sources.list with suite and components",
+			target: "/api/mirrorlist?route=debian&format=sources.list&suite=bookworm&components=main,contrib",
+			lines:  []string{"deb http://deb.mirror/debian/ bookworm main contrib"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := do(api, http.MethodGet, tc.target)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+			}
+
+			got := lines(rec.Body.String())
+			if strings.Join(got, "\n") != strings.Join(tc.lines, "\n") {
+				t.Fatalf("expected mirrorlist:\n%s\ngot:\n%s", strings.Join(tc.lines, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestAPI_Sorts_Mirrorlist_By_Throughput(t *testing.T) {
+	t.Parallel()
+
+	// Ranked by latency, the slow mirror goes first.
+	st := stats.New(stats.Config{Scoring: stats.ScoringLatency})
+	st.Update("fast:https://fast.mirror/", stats.Sample{
+		Bytes:    30 * 1024 * 1024,
+		Duration: 1500 * time.Millisecond,
+		TTFB:     500 * time.Millisecond,
+	})
+	st.Update("slow:https://slow.mirror/", stats.Sample{
+		Bytes:    10 * 1024 * 1024,
+		Duration: 1100 * time.Millisecond,
+		TTFB:     100 * time.Millisecond,
+	})
+
+	api := admin.New(map[string]*pool.Pool{"plain": pool.New(pool.Config{Name: "plain"}, st, nil)}, nil)
+	rec := do(api, http.MethodGet, "/api/mirrorlist")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	expected := []string{"https://fast.mirror/", "https://slow.mirror/"}
+	if got := lines(rec.Body.String()); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected mirrors %v, got %v", expected, got)
+	}
+}
+
+func TestAPI_Rejects_Invalid_Requests(t *testing.T) {
+	t.Parallel()
+
+	api := newAPI()
+	for _, tc := range []struct {
+		method string
+		target string
+		status int
+	}{
+		// A mirrorlist can only be rendered for a single route.
+		{method: http.MethodGet, target: "/api/mirrorlist", status: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/api/mirrorlist?route=fedora", status: http.StatusNotFound},
+		{method: http.MethodGet, target: "/api/mirrorlist?route=arch&format=yum", status: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/api/mirrorlist?route=arch", status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/api/workers", status: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, target: "/api/workers?route=fedora", status: http.StatusNotFound},
+		{method: http.MethodGet, target: "/api/evict?worker=fast", status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/api/evict", status: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/api/evict?worker=missing", status: http.StatusNotFound},
+		{method: http.MethodPost, target: "/api/pins", status: http.StatusBadRequest},
+		{method: http.MethodPut, target: "/api/bans?mirror=http://slow.mirror/", status: http.StatusMethodNotAllowed},
+		{method: http.MethodDelete, target: "/api/quarantine", status: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/api/quarantine", status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/api/candidates", status: http.StatusMethodNotAllowed},
+	} {
+		rec := do(api, tc.method, tc.target)
+		if rec.Code != tc.status {
+			t.Fatalf("expected %s %s to return %d, got %d", tc.method, tc.target, tc.status, rec.Code)
+		}
+	}
+}
+
+func TestAPI_Manages_Pins(t *testing.T) {
+	t.Parallel()
+
+	api := newAPI()
+	const mirror = "http://slow.mirror/archlinux/"
+	if rec := do(api, http.MethodPost, "/api/pins?route=arch&mirror="+mirror); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	rec := do(api, http.MethodGet, "/api/pins")
+	if body := strings.TrimSpace(rec.Body.String()); body != `["`+mirror+`"]` {
+		t.Fatalf("unexpected pins %s", body)
+	}
+
+	if rec := do(api, http.MethodDelete, "/api/pins?mirror="+mirror); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	rec = do(api, http.MethodGet, "/api/pins?route=arch")
+	if body := strings.TrimSpace(rec.Body.String()); body != `[]` {
+		t.Fatalf("unexpected pins %s", body)
+	}
+}
@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"io"
+	"net/http"
+	"roob.re/refractor/stats"
+	"strings"
+	"time"
+)
+
+// Formats in which the mirrorlist endpoint can render the ranking of a pool.
+const (
+	// FormatPacman renders an Arch Linux /etc/pacman.d/mirrorlist.
+	FormatPacman = "pacman"
+	// FormatSourcesList renders Debian or Ubuntu sources.list entries.
+	FormatSourcesList = "sources.list"
+	// FormatPlain renders one mirror URL per line.
+	FormatPlain = "plain"
+)
+
+const (
+	defaultSuite      = "stable"
+	defaultComponents = "main"
+)
+
+// rankedMirror is a mirror in the ranking, along with the stats of the fastest worker bound to it.
+type rankedMirror struct {
+	url        string
+	throughput float64
+	samples    int
+	country    string
+}
+
+// mirrorlist renders the ranking of a route as a list of mirrors, sorted by throughput, that can be used directly by
+// package managers.
+func (a *API) mirrorlist(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes, err := a.selected(r)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	if len(routes) != 1 {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("a route parameter is required when serving several routes"))
+		return
+	}
+
+	route := routes[0]
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = a.formats[route]
+	}
+	if format == "" {
+		format = FormatPlain
+	}
+
+	var render func(io.Writer, rankedMirror)
+	switch format {
+	case FormatPacman:
+		render = func(w io.Writer, m rankedMirror) {
+			fmt.Fprintf(w, "Server = %s/$repo/os/$arch\n", strings.TrimSuffix(m.url, "/"))
+		}
+	case FormatSourcesList:
+		suite := r.URL.Query().Get("suite")
+		if suite == "" {
+			suite = defaultSuite
+		}
+
+		components := r.URL.Query().Get("components")
+		if components == "" {
+			components = defaultComponents
+		}
+		components = strings.ReplaceAll(components, ",", " ")
+
+		render = func(w io.Writer, m rankedMirror) {
+			fmt.Fprintf(w, "deb %s %s %s\n", m.url, suite, components)
+		}
+	case FormatPlain:
+		render = func(w io.Writer, m rankedMirror) {
+			fmt.Fprintln(w, m.url)
+		}
+	default:
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+
+	generated := time.Now().UTC().Format(time.RFC1123)
+	fmt.Fprintf(rw, "# Generated by Refractor from the ranking of route %q on %s\n", route, generated)
+	for _, m := range a.rankedMirrors(route) {
+		if m.country != "" {
+			fmt.Fprintf(rw, "\n# %.2f MiB/s, %d samples, %s\n", m.throughput/1024/1024, m.samples, m.country)
+		} else {
+			fmt.Fprintf(rw, "\n# %.2f MiB/s, %d samples\n", m.throughput/1024/1024, m.samples)
+		}
+		render(rw, m)
+	}
+}
+
+// rankedMirrors returns the mirrors in the ranking of the given route, sorted by throughput regardless of how the
+// ranking itself is scored. Mirrors appearing more than once in the ranking are listed only once, in the position of
+// their fastest worker.
+func (a *API) rankedMirrors(route string) []rankedMirror {
+	entries := a.pools[route].Stats().Ranking()
+	slices.SortStableFunc(entries, func(e1, e2 stats.Entry) bool {
+		return e1.Throughput > e2.Throughput
+	})
+
+	var mirrors []rankedMirror
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[entry.Mirror] {
+			continue
+		}
+		seen[entry.Mirror] = true
+
+		mirrors = append(mirrors, rankedMirror{
+			url:        entry.Mirror,
+			throughput: entry.Throughput,
+			samples:    entry.Samples,
+			country:    entry.Metadata.Country,
+		})
+	}
+
+	return mirrors
+}
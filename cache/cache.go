@@ -0,0 +1,381 @@
+// Package cache implements an on-disk content cache for files served through the pool.
+package cache
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tmpDir = ".tmp"
+
+// Class describes how a file should be treated by the cache.
+type Class int
+
+const (
+	// Uncacheable files are never stored nor served from the cache.
+	Uncacheable Class = iota
+	// Immutable files never change once published, and are served from the cache without contacting any mirror.
+	Immutable
+	// Revalidate files change over time, and are only served from the cache if a mirror reports they have not been
+	// modified since they were stored.
+	Revalidate
+)
+
+var (
+	immutableSuffixes = []string{".deb", ".rpm"}
+	// immutableInfixes are matched anywhere in the file name, as package archives can have several compressions.
+	immutableInfixes   = []string{".pkg.tar."}
+	revalidateSuffixes = []string{".db", ".files", ".db.sig", ".files.sig"}
+)
+
+// Classify returns the Class for the file at the given URL path.
+func Classify(urlPath string) Class {
+	if strings.HasSuffix(urlPath, "/") {
+		return Uncacheable
+	}
+
+	name := path.Base(urlPath)
+	for _, suffix := range revalidateSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return Revalidate
+		}
+	}
+
+	for _, suffix := range immutableSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return Immutable
+		}
+	}
+
+	for _, infix := range immutableInfixes {
+		if strings.Contains(name, infix) {
+			return Immutable
+		}
+	}
+
+	return Uncacheable
+}
+
+type Config struct {
+	// Dir is the directory where cached files are stored. Caching is disabled if empty.
+	Dir string `yaml:"dir"`
+	// MaxSizeMiBs is the maximum size of the cache. Least recently used files are removed to stay below it.
+	MaxSizeMiBs int64 `yaml:"maxSizeMiBs"`
+}
+
+func (c Config) WithDefaults() Config {
+	if c.MaxSizeMiBs == 0 {
+		c.MaxSizeMiBs = 10 * 1024
+	}
+
+	return c
+}
+
+type Cache struct {
+	Config
+	sync.Mutex
+	entries map[string]*entry
+	size    int64
+}
+
+type entry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// New creates a cache on Config.Dir, indexing the files already present there.
+func New(c Config) (*Cache, error) {
+	c = c.WithDefaults()
+
+	cache := &Cache{
+		Config:  c,
+		entries: map[string]*entry{},
+	}
+
+	err := os.RemoveAll(filepath.Join(c.Dir, tmpDir))
+	if err != nil {
+		return nil, fmt.Errorf("cleaning up temporary files: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Join(c.Dir, tmpDir), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache dir: %w", err)
+	}
+
+	err = filepath.WalkDir(c.Dir, func(fsPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(c.Dir, fsPath)
+		if err != nil {
+			return err
+		}
+
+		cache.entries["/"+filepath.ToSlash(rel)] = &entry{
+			size:       info.Size(),
+			lastAccess: info.ModTime(),
+		}
+		cache.size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("indexing cache dir: %w", err)
+	}
+
+	log.Infof("Cache at %s contains %d files (%.1f MiB)", c.Dir, len(cache.entries), float64(cache.size)/1024/1024)
+	cache.Lock()
+	cache.evict(0)
+	cache.Unlock()
+
+	return cache, nil
+}
+
+// Serve writes the cached copy of the requested file to rw, using http.ServeContent to honor conditional and range
+// headers present in r. Serve returns false, having written nothing, if the file is not cached.
+func (c *Cache) Serve(rw http.ResponseWriter, r *http.Request) bool {
+	key := clean(r.URL.Path)
+
+	c.Lock()
+	e, found := c.entries[key]
+	if found {
+		e.lastAccess = time.Now()
+	}
+	c.Unlock()
+
+	if !found {
+		return false
+	}
+
+	file, err := os.Open(c.fsPath(key))
+	if err != nil {
+		log.Warnf("Could not open cached file for %s: %v", key, err)
+		c.remove(key)
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Warnf("Could not stat cached file for %s: %v", key, err)
+		return false
+	}
+
+	log.Infof("Serving %s from cache", key)
+	http.ServeContent(rw, r, path.Base(key), info.ModTime(), file)
+	return true
+}
+
+// ModTime returns the modification time of the cached copy of urlPath, as reported by the mirror it was fetched from.
+func (c *Cache) ModTime(urlPath string) (time.Time, bool) {
+	key := clean(urlPath)
+
+	c.Lock()
+	_, found := c.entries[key]
+	c.Unlock()
+
+	if !found {
+		return time.Time{}, false
+	}
+
+	info, err := os.Stat(c.fsPath(key))
+	if err != nil {
+		c.remove(key)
+		return time.Time{}, false
+	}
+
+	return info.ModTime(), true
+}
+
+// Writer returns a Writer that stores a file in the cache. The file will only be visible to readers after
+// Writer.Commit is called, and only if exactly size bytes were written to it. A negative size disables this check.
+func (c *Cache) Writer(urlPath string, size int64, modTime time.Time) (*Writer, error) {
+	if size > c.MaxSizeMiBs*1024*1024 {
+		return nil, fmt.Errorf("%s is larger than the cache", urlPath)
+	}
+
+	file, err := os.CreateTemp(filepath.Join(c.Dir, tmpDir), "fill-")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	return &Writer{
+		cache:    c,
+		key:      clean(urlPath),
+		file:     file,
+		expected: size,
+		modTime:  modTime,
+	}, nil
+}
+
+func (c *Cache) add(key string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if old, found := c.entries[key]; found {
+		c.size -= old.size
+	}
+
+	c.entries[key] = &entry{
+		size:       size,
+		lastAccess: time.Now(),
+	}
+	c.size += size
+
+	c.evict(0)
+}
+
+func (c *Cache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.removeLocked(key)
+}
+
+func (c *Cache) removeLocked(key string) {
+	e, found := c.entries[key]
+	if !found {
+		return
+	}
+
+	delete(c.entries, key)
+	c.size -= e.size
+
+	err := os.Remove(c.fsPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Could not remove %s from cache: %v", key, err)
+	}
+}
+
+// evict removes least recently used files until the cache has room for extra bytes. Lock must be held by the caller.
+func (c *Cache) evict(extra int64) {
+	maxSize := c.MaxSizeMiBs * 1024 * 1024
+	if c.size+extra <= maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, func(a, b string) bool {
+		return c.entries[a].lastAccess.Before(c.entries[b].lastAccess)
+	})
+
+	for _, key := range keys {
+		if c.size+extra <= maxSize {
+			break
+		}
+
+		log.Debugf("Evicting %s from cache", key)
+		c.removeLocked(key)
+	}
+}
+
+func (c *Cache) fsPath(key string) string {
+	return filepath.Join(c.Dir, filepath.FromSlash(key))
+}
+
+// clean turns an URL path into a cache key, ensuring it cannot escape the cache directory.
+func clean(urlPath string) string {
+	return path.Clean("/" + urlPath)
+}
+
+// Writer stores a file in the cache as it is being streamed to a client.
+// Errors writing to disk are not reported to the caller, so a Writer can be safely combined with io.MultiWriter
+// without disrupting the transfer. Instead, the file is discarded when Commit is called.
+type Writer struct {
+	cache    *Cache
+	key      string
+	file     *os.File
+	written  int64
+	expected int64
+	modTime  time.Time
+	err      error
+}
+
+func (w *Writer) Write(buf []byte) (int, error) {
+	if w.err != nil {
+		return len(buf), nil
+	}
+
+	n, err := w.file.Write(buf)
+	w.written += int64(n)
+	if err != nil {
+		w.err = err
+	}
+
+	return len(buf), nil
+}
+
+// Commit makes the written file available in the cache.
+func (w *Writer) Commit() error {
+	defer os.Remove(w.file.Name())
+
+	err := w.file.Close()
+	if w.err == nil {
+		w.err = err
+	}
+
+	if w.err != nil {
+		return fmt.Errorf("writing %s to cache: %w", w.key, w.err)
+	}
+
+	if w.expected >= 0 && w.written != w.expected {
+		return fmt.Errorf("incomplete file %s: expected %d bytes, got %d", w.key, w.expected, w.written)
+	}
+
+	err = os.Chtimes(w.file.Name(), time.Now(), w.modTime)
+	if err != nil {
+		return fmt.Errorf("setting modification time of %s: %w", w.key, err)
+	}
+
+	w.cache.Lock()
+	w.cache.evict(w.written)
+	w.cache.Unlock()
+
+	dest := w.cache.fsPath(w.key)
+	err = os.MkdirAll(filepath.Dir(dest), 0o755)
+	if err != nil {
+		return fmt.Errorf("creating directory for %s: %w", w.key, err)
+	}
+
+	err = os.Rename(w.file.Name(), dest)
+	if err != nil {
+		return fmt.Errorf("moving %s into the cache: %w", w.key, err)
+	}
+
+	w.cache.add(w.key, w.written)
+	log.Debugf("Stored %s in cache (%d bytes)", w.key, w.written)
+
+	return nil
+}
+
+// Abort discards the written file.
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,98 @@
+package cache_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/cache"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path  string
+		class cache.Class
+	}{
+		{path: "/core/os/x86_64/linux-5.18.3.arch1-1-x86_64.pkg.tar.zst", class: cache.Immutable},
+		{path: "/core/os/x86_64/linux-5.18.3.arch1-1-x86_64.pkg.tar.zst.sig", class: cache.Immutable},
+		{path: "/core/os/x86_64/core.db", class: cache.Revalidate},
+		{path: "/core/os/x86_64/core.db.sig", class: cache.Revalidate},
+		{path: "/extra/os/x86_64/extra.files", class: cache.Revalidate},
+		{path: "/lastsync", class: cache.Uncacheable},
+		{path: "/core/os/x86_64/", class: cache.Uncacheable},
+	} {
+		if class := cache.Classify(tc.path); class != tc.class {
+			t.Errorf("expected %s to be class %d, got %d", tc.path, tc.class, class)
+		}
+	}
+}
+
+func TestCache_Stores_And_Serves(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const path = "/core/os/x86_64/foo.pkg.tar.zst"
+	const body = "lorem ipsum dolor sit amet"
+	modTime := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	rec := httptest.NewRecorder()
+	if c.Serve(rec, httptest.NewRequest(http.MethodGet, path, nil)) {
+		t.Fatal("empty cache served a file")
+	}
+
+	w, err := c.Writer(path, int64(len(body)), modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = io.Copy(w, strings.NewReader(body))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached, found := c.ModTime(path); !found || !cached.Equal(modTime) {
+		t.Fatalf("unexpected modification time %v", cached)
+	}
+
+	rec = httptest.NewRecorder()
+	if !c.Serve(rec, httptest.NewRequest(http.MethodGet, path, nil)) {
+		t.Fatal("cached file was not served")
+	}
+
+	if rec.Body.String() != body {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestCache_Discards_Incomplete_Files(t *testing.T) {
+	t.Parallel()
+
+	c, err := cache.New(cache.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const path = "/core/os/x86_64/foo.pkg.tar.zst"
+
+	w, err := c.Writer(path, 100, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = io.Copy(w, strings.NewReader("too short"))
+	if err := w.Commit(); err == nil {
+		t.Fatal("incomplete file was committed")
+	}
+
+	if _, found := c.ModTime(path); found {
+		t.Fatal("incomplete file is present in cache")
+	}
+}
@@ -37,6 +37,9 @@ func (c Config) WithDefaults() Config {
 }
 
 type Request struct {
+	// Context is the context of the client request being served. The request to the mirror is aborted when it is done.
+	// It must not be nil.
+	Context      context.Context
 	Path         string
 	Header       http.Header
 	ResponseChan chan Response
@@ -46,7 +49,9 @@ type Response struct {
 	HTTPResponse *http.Response
 	Worker       string
 	Error        error
-	Done         func(written int64)
+	// Done must be called after the body of HTTPResponse has been consumed, with the number of bytes read from it and
+	// the error that interrupted the read, if any.
+	Done func(read int64, err error)
 }
 
 func NewClient(c Config, baseUrl string) *Client {
@@ -112,13 +117,9 @@ func (c *Client) Do(request Request) (r Response) {
 	c.resolver.Refresh(true)
 
 	// TODO: Calculate a better deadline by making a HEAD request and a target throughput
-	//ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(2*time.Second))
-	//defer cancel()
-
 	url := c.URL(request.Path)
 
-	//req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(request.Context, http.MethodGet, url, nil)
 	if err != nil {
 		r.Error = fmt.Errorf("building request to %s: %w", url, err)
 		return
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
 	"roob.re/refractor/server"
+	"syscall"
 )
 
 func main() {
 	configPath := flag.String("config", "refractor.yaml", "Path to refractor.yaml file")
 	address := flag.String("address", ":8080", "Address to listen on")
+	adminAddress := flag.String("admin-address", "", "Address to serve admin endpoints, such as /metrics and /api, on. Disabled if empty")
 	logLvl := flag.String("log-level", "info", "Verbosity level. Accepts levels understood by logrus")
 	flag.Parse()
 
@@ -30,7 +34,10 @@ func main() {
 		log.Fatalf("Could not create server: %v", err)
 	}
 
-	err = s.Run(*address)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err = s.Run(ctx, *address, *adminAddress)
 	if err != nil {
 		log.Errorf("Server exited with error: %v", err)
 	}
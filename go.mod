@@ -3,14 +3,23 @@ module roob.re/refractor
 go 1.18
 
 require (
+	github.com/prometheus/client_golang v1.12.2
+	github.com/rs/dnscache v0.0.0-20211102005908-e0241e321417
 	github.com/sirupsen/logrus v1.8.1
+	github.com/yelinaung/go-haikunator v0.0.0-20220607145230-74ef2cbd6d59
 	golang.org/x/exp v0.0.0-20220602145555-4a0574d9293f
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/rs/dnscache v0.0.0-20211102005908-e0241e321417 // indirect
-	github.com/yelinaung/go-haikunator v0.0.0-20220607145230-74ef2cbd6d59 // indirect
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
-	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
@@ -0,0 +1,191 @@
+// Package metrics defines the prometheus metrics exported by Refractor.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"roob.re/refractor/stats"
+)
+
+const namespace = "refractor"
+
+// Metrics are labeled with the route served by the pool they refer to.
+var routeLabel = []string{"route"}
+
+var (
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of times a request or transfer has been retried on a different worker.",
+	}, routeLabel)
+
+	retriesExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_exhausted_total",
+		Help:      "Number of requests that failed after exhausting all retries.",
+	}, routeLabel)
+
+	peekTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peek_timeouts_total",
+		Help:      "Number of responses from mirrors that failed to deliver the peeked bytes in time.",
+	}, routeLabel)
+
+	servedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "served_bytes_total",
+		Help:      "Number of body bytes written to clients, by source.",
+	}, append(routeLabel, "source"))
+
+	redirects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Number of requests answered with a redirect to a mirror instead of being proxied.",
+	}, routeLabel)
+
+	hedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_requests_total",
+		Help:      "Number of requests sent to two workers at once, keeping the response that arrived first.",
+	}, routeLabel)
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_queue_wait_seconds",
+		Help:      "Time requests spend waiting for a worker to pick them up.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, routeLabel)
+
+	providerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_errors_total",
+		Help:      "Number of errors returned by the provider when asked for a mirror.",
+	}, routeLabel)
+
+	evictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_evictions_total",
+		Help:      "Number of workers evicted from the pool, by reason.",
+	}, append(routeLabel, "reason"))
+)
+
+// Route contains the metrics for the pool serving a route, already labeled with its name.
+type Route struct {
+	Retries          prometheus.Counter
+	RetriesExhausted prometheus.Counter
+	PeekTimeouts     prometheus.Counter
+	// ServedBytes is labeled by source.
+	ServedBytes    *prometheus.CounterVec
+	Redirects      prometheus.Counter
+	Hedges         prometheus.Counter
+	QueueWait      prometheus.Observer
+	ProviderErrors prometheus.Counter
+	// Evictions is labeled by reason.
+	Evictions *prometheus.CounterVec
+}
+
+// ForRoute returns the metrics for the given route.
+func ForRoute(route string) *Route {
+	labels := prometheus.Labels{"route": route}
+
+	return &Route{
+		Retries:          retries.With(labels),
+		RetriesExhausted: retriesExhausted.With(labels),
+		PeekTimeouts:     peekTimeouts.With(labels),
+		ServedBytes:      servedBytes.MustCurryWith(labels),
+		Redirects:        redirects.With(labels),
+		Hedges:           hedges.With(labels),
+		QueueWait:        queueWait.With(labels),
+		ProviderErrors:   providerErrors.With(labels),
+		Evictions:        evictions.MustCurryWith(labels),
+	}
+}
+
+// Eviction reasons.
+const (
+	EvictionPerformance = "performance"
+	EvictionError       = "error"
+	EvictionTransfer    = "transfer"
+	EvictionManual      = "manual"
+)
+
+// Sources of served bytes.
+const (
+	SourceMirror = "mirror"
+	SourceCache  = "cache"
+)
+
+func init() {
+	prometheus.MustRegister(
+		retries,
+		retriesExhausted,
+		peekTimeouts,
+		servedBytes,
+		redirects,
+		hedges,
+		queueWait,
+		providerErrors,
+		evictions,
+	)
+}
+
+// Handler returns an http.Handler that serves the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statsCollector reports the ranking of a stats.Stats every time metrics are collected.
+type statsCollector struct {
+	stats          *stats.Stats
+	throughputDesc *prometheus.Desc
+	samplesDesc    *prometheus.Desc
+	latencyDesc    *prometheus.Desc
+}
+
+// RegisterStats registers collectors for the per-mirror metrics kept in s, for the given route.
+func RegisterStats(route string, s *stats.Stats) {
+	labels := prometheus.Labels{"route": route}
+
+	prometheus.MustRegister(statsCollector{
+		stats: s,
+		throughputDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "mirror", "throughput_bytes_per_second"),
+			"Average throughput of a mirror in the pool, as used for ranking.",
+			[]string{"mirror"}, labels,
+		),
+		samplesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "mirror", "samples"),
+			"Number of samples in the throughput average of a mirror in the pool.",
+			[]string{"mirror"}, labels,
+		),
+		latencyDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "mirror", "ttfb_seconds"),
+			"Average time to first byte of a mirror in the pool.",
+			[]string{"mirror"}, labels,
+		),
+	})
+}
+
+func (sc statsCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- sc.throughputDesc
+	descs <- sc.samplesDesc
+	descs <- sc.latencyDesc
+}
+
+// Collect reports the stats of the best ranked worker of each mirror. Metrics are not labeled by worker, as workers come
+// and go and each of them would leave a new series behind.
+func (sc statsCollector) Collect(metrics chan<- prometheus.Metric) {
+	seen := map[string]bool{}
+	for _, entry := range sc.stats.Ranking() {
+		mirror := entry.Mirror
+		if seen[mirror] {
+			continue
+		}
+		seen[mirror] = true
+
+		metrics <- prometheus.MustNewConstMetric(sc.throughputDesc, prometheus.GaugeValue, entry.Throughput, mirror)
+		metrics <- prometheus.MustNewConstMetric(sc.samplesDesc, prometheus.GaugeValue, float64(entry.Samples), mirror)
+		metrics <- prometheus.MustNewConstMetric(sc.latencyDesc, prometheus.GaugeValue, entry.Latency.Seconds(), mirror)
+	}
+}
@@ -0,0 +1,30 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"roob.re/refractor/provider/types"
+)
+
+// setProvider records the provider feeding the pool.
+func (p *Pool) setProvider(provider types.Provider) {
+	p.provider.Lock()
+	defer p.provider.Unlock()
+
+	p.provider.Provider = provider
+}
+
+// Candidates returns all the mirrors the provider feeding the pool might return, along with their metadata. It fails
+// if the provider is not a types.MetadataProvider.
+func (p *Pool) Candidates(ctx context.Context) ([]types.Mirror, error) {
+	p.provider.Lock()
+	provider := p.provider.Provider
+	p.provider.Unlock()
+
+	mp, ok := provider.(types.MetadataProvider)
+	if !ok {
+		return nil, fmt.Errorf("provider cannot list its mirrors")
+	}
+
+	return mp.Mirrors(ctx)
+}
@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Policies for workers bound to the same mirror, see Config.MirrorPolicy.
+const (
+	MirrorPolicyUnique  = "unique"
+	MirrorPolicyPerHost = "perHost"
+	MirrorPolicyAny     = "any"
+)
+
+// mirrorKey returns the key that identifies mirror under the configured MirrorPolicy, and the maximum number of
+// workers that can be bound to mirrors with the same key. A limit of zero means there is no limit.
+func (p *Pool) mirrorKey(mirror string) (string, int) {
+	switch p.MirrorPolicy {
+	case MirrorPolicyUnique:
+		return sameMirror(mirror), 1
+	case MirrorPolicyPerHost:
+		return sameHost(mirror), p.MaxWorkersPerHost
+	default:
+		return "", 0
+	}
+}
+
+// admits returns whether a new worker bound to mirror is allowed in the pool, given the mirrors the active workers are
+// bound to.
+func (p *Pool) admits(mirror string, bound []string) bool {
+	key, limit := p.mirrorKey(mirror)
+	if limit <= 0 {
+		return true
+	}
+
+	n := 0
+	for _, other := range bound {
+		if otherKey, _ := p.mirrorKey(other); otherKey == key {
+			n++
+		}
+	}
+
+	return n < limit
+}
+
+// sameHost returns a key that is equal for mirrors in the same host, regardless of their scheme, port and path.
+func sameHost(mirror string) string {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" {
+		return mirror
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// sameMirror returns a key that is equal for URLs pointing to the same mirror, regardless of their scheme and of
+// whether they specify the default port for it.
+func sameMirror(mirror string) string {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" {
+		return mirror
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return host + "/" + strings.Trim(u.Path, "/")
+}
@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"roob.re/refractor/provider/types"
+	"sync"
+	"time"
+)
+
+const (
+	// freshnessTimeout is the maximum time to wait for a mirror to tell when it was last updated.
+	freshnessTimeout = 10 * time.Second
+	// defaultMaxMirrorLag is the default for Config.MaxMirrorLag.
+	defaultMaxMirrorLag = 12 * time.Hour
+	// reasonOutdated is the quarantine reason for mirrors rejected for lagging behind.
+	reasonOutdated = "outdated"
+)
+
+// freshness keeps track of the most recent update seen in any of the mirrors checked.
+type freshness struct {
+	sync.Mutex
+	latest  time.Time
+	updates map[string]time.Time
+}
+
+// observe records the last update of mirror, and returns the most recent update seen so far.
+func (f *freshness) observe(mirror string, update time.Time) time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.updates == nil {
+		f.updates = map[string]time.Time{}
+	}
+	f.updates[mirror] = update
+
+	if update.After(f.latest) {
+		f.latest = update
+	}
+
+	return f.latest
+}
+
+// lastUpdate returns the last update seen for mirror, if it has been checked.
+func (f *freshness) lastUpdate(mirror string) (time.Time, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	update, found := f.updates[mirror]
+	return update, found
+}
+
+// checkFreshness returns an error if mirror lags more than MaxMirrorLag behind the most up-to-date mirror checked so
+// far, or if it cannot tell when it was last updated.
+func (p *Pool) checkFreshness(checker types.FreshnessChecker, mirror string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), freshnessTimeout)
+	defer cancel()
+
+	update, err := checker.LastUpdate(ctx, mirror)
+	if errors.Is(err, types.ErrUnknownFreshness) {
+		log.Debugf("Not checking freshness of %s: %v", mirror, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking last update: %w", err)
+	}
+
+	latest := p.freshness.observe(mirror, update)
+	if lag := latest.Sub(update); lag > p.MaxMirrorLag {
+		return fmt.Errorf("last updated %s behind the most up-to-date mirror", lag.Round(time.Minute))
+	}
+
+	log.Debugf("Mirror %s was last updated on %s", mirror, update.Format(time.RFC3339))
+	return nil
+}
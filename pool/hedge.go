@@ -0,0 +1,206 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"roob.re/refractor/cache"
+	"roob.re/refractor/client"
+	"roob.re/refractor/pool/peeker"
+	"time"
+)
+
+// hedgeWidth is the number of workers a hedged request is sent to.
+const hedgeWidth = 2
+
+// hedgeTimeout is the maximum time to wait for a worker to pick up its copy of a hedged request.
+const hedgeTimeout = 2 * time.Second
+
+// hedgedResponse is the outcome of one of the copies of a hedged request.
+type hedgedResponse struct {
+	response client.Response
+	// peeked contains the first bytes of the body of response, which have already been read from it.
+	peeked []byte
+	// err is not nil if response cannot be served, either because it failed or because its body could not be peeked.
+	err error
+	// cancel aborts this copy of the request.
+	cancel context.CancelFunc
+	// index identifies the copy of the request among the rest.
+	index int
+}
+
+// discard releases a response that is not going to be served. Its copy of the request must have been cancelled before,
+// so its worker does not record a sample for it.
+func (hr hedgedResponse) discard() {
+	hr.cancel()
+
+	if hr.response.HTTPResponse == nil {
+		return
+	}
+
+	hr.response.HTTPResponse.Body.Close()
+	if hr.err == nil {
+		hr.response.Done(0, nil)
+	}
+}
+
+// errNotPickedUp is returned for the copies of a hedged request that no worker picked up in time.
+var errNotPickedUp = errors.New("worker did not pick up the request in time")
+
+// replayedBody reads the bytes peeked from a body before the rest of it.
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// hedged returns whether the request of t should be hedged, which is the case for small files, as latency dominates
+// their transfer time. Repository databases are always hedged, and other files only if a range no larger than
+// HedgeSizeKiBs is requested, as the size of a whole file is not known before requesting it.
+func (p *Pool) hedged(t *transfer) bool {
+	if p.HedgeSizeKiBs <= 0 || p.Workers < hedgeWidth || t.headerWritten || t.r.Method != http.MethodGet {
+		return false
+	}
+
+	if cache.Classify(t.r.URL.Path) == cache.Revalidate {
+		return true
+	}
+
+	remaining := t.remaining()
+	return remaining >= 0 && remaining <= p.HedgeSizeKiBs*1024
+}
+
+// dispatchHedged sends a copy of request to several different workers, and returns the first response whose body is
+// peeked successfully. The rest are cancelled, which does not count against the performance of their workers. If all of
+// them fail, the first failure is returned. If there are not enough workers to pick up the copies, request is
+// dispatched as usual.
+// The returned function must be called once the response has been consumed.
+func (p *Pool) dispatchHedged(request client.Request) (client.Response, context.CancelFunc) {
+	directs := p.workers.directs(hedgeWidth)
+	if len(directs) < hedgeWidth {
+		log.Debugf("Not enough workers to hedge %s, sending it to any worker", request.Path)
+		return p.dispatch(request), func() {}
+	}
+
+	p.metrics.Hedges.Inc()
+
+	responses := make(chan hedgedResponse, hedgeWidth)
+	cancels := make([]context.CancelFunc, 0, hedgeWidth)
+	for i, direct := range directs {
+		ctx, cancel := context.WithCancel(request.Context)
+		cancels = append(cancels, cancel)
+
+		copied := request
+		copied.Context = ctx
+		copied.ResponseChan = make(chan client.Response)
+		go func(i int, direct chan client.Request) {
+			hr := p.hedgedRequest(copied, direct)
+			hr.cancel = cancel
+			hr.index = i
+			responses <- hr
+		}(i, direct)
+	}
+
+	var failed *hedgedResponse
+	for i := 0; i < hedgeWidth; i++ {
+		hr := <-responses
+		if errors.Is(hr.err, errNotPickedUp) {
+			hr.cancel()
+			continue
+		}
+
+		if hr.err != nil {
+			log.Debugf("Hedged request for %s failed: %v", request.Path, hr.err)
+			if failed == nil {
+				failed = &hr
+			} else {
+				hr.discard()
+			}
+
+			continue
+		}
+
+		if failed != nil {
+			failed.discard()
+		}
+
+		// Cancel the copies that lost the race, and release their responses once they arrive. The winner keeps its
+		// context until it has been consumed, so its body can be read to the end and its sample is recorded.
+		for j, cancel := range cancels {
+			if j != hr.index {
+				cancel()
+			}
+		}
+
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				(<-responses).discard()
+			}
+		}(hedgeWidth - i - 1)
+
+		log.Debugf("Hedged request for %s won by %s", request.Path, hr.response.Worker)
+		body := hr.response.HTTPResponse.Body
+		hr.response.HTTPResponse.Body = replayedBody{
+			Reader: io.MultiReader(bytes.NewReader(hr.peeked), body),
+			Closer: body,
+		}
+		return hr.response, hr.cancel
+	}
+
+	if failed == nil {
+		// Workers were too busy to pick up any of the copies, which is not a failure.
+		log.Debugf("No worker picked up hedged request for %s, sending it to any worker", request.Path)
+		return p.dispatch(request), func() {}
+	}
+
+	return failed.response, failed.cancel
+}
+
+// hedgedRequest sends one of the copies of a hedged request to the worker listening on direct, and peeks the body of
+// its response.
+func (p *Pool) hedgedRequest(request client.Request, direct chan client.Request) hedgedResponse {
+	hr := hedgedResponse{}
+	select {
+	case direct <- request:
+	case <-time.After(hedgeTimeout):
+		hr.err = errNotPickedUp
+		return hr
+	case <-request.Context.Done():
+		hr.err = request.Context.Err()
+		return hr
+	}
+
+	hr.response = awaitResponse(request)
+	if hr.response.Error != nil {
+		hr.err = hr.response.Error
+		return hr
+	}
+
+	if status := hr.response.HTTPResponse.StatusCode; status >= 400 {
+		hr.err = fmt.Errorf("%s%s returned non-200 status: %d", hr.response.Worker, request.Path, status)
+		return hr
+	}
+
+	peeked, err := p.peeker.PeekContext(request.Context, hr.response.HTTPResponse.Body)
+	if err != nil {
+		if errors.Is(err, peeker.ErrPeekTimeout) {
+			p.metrics.PeekTimeouts.Inc()
+		}
+
+		// The peeker might still be reading from body, so we cannot look into it.
+		hr.response.HTTPResponse.Body.Close()
+		hr.response.Done(0, nil)
+		hr.response = client.Response{
+			Worker: hr.response.Worker,
+			Error:  fmt.Errorf("peeking response body: %w", err),
+		}
+		hr.err = hr.response.Error
+		return hr
+	}
+
+	hr.peeked = peeked
+	return hr
+}
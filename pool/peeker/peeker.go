@@ -21,7 +21,13 @@ type peekResult struct {
 
 // Peek attempts to get a few bytes from the body within some time.
 func (p *Peeker) Peek(body io.Reader) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	return p.PeekContext(context.Background(), body)
+}
+
+// PeekContext is like Peek, but gives up early if parent is done. In that case, the error of parent is returned
+// instead of ErrPeekTimeout.
+func (p *Peeker) PeekContext(parent context.Context, body io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(parent, p.Timeout)
 	defer cancel()
 
 	readChan := p.readContext(ctx, body)
@@ -30,6 +36,10 @@ func (p *Peeker) Peek(body io.Reader) ([]byte, error) {
 	case result := <-readChan:
 		return result.buf, result.err
 	case <-ctx.Done():
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+
 		return nil, ErrPeekTimeout
 	}
 }
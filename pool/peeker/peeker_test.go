@@ -2,6 +2,7 @@ package peeker_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -118,3 +119,26 @@ func TestPeeker_Times_Out(t *testing.T) {
 		t.Fatal("peeker left unexpected stuf fin the buffer")
 	}
 }
+
+func TestPeeker_Gives_Up_When_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	reader := delayReader{strings.NewReader(full)}
+	pk := peeker.Peeker{
+		SizeBytes: int64(len(part1)),
+		Timeout:   5 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := pk.PeekContext(ctx, reader)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error from context, got %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("peeker did not give up when the context was done")
+	}
+}
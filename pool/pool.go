@@ -1,34 +1,70 @@
 package pool
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"roob.re/refractor/cache"
 	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
 	"roob.re/refractor/names"
 	"roob.re/refractor/pool/peeker"
 	"roob.re/refractor/provider/types"
 	"roob.re/refractor/stats"
 	"roob.re/refractor/worker"
 	"strings"
+	"sync"
 	"time"
 )
 
+// maxRedraws is the number of consecutive quarantined or duplicated mirrors returned by the provider after which feed
+// waits before asking for more.
+const maxRedraws = 50
+
 type Pool struct {
 	Config
-	stats  *stats.Stats
-	peeker peeker.Peeker
-	namer  func() string
+	stats   *stats.Stats
+	cache   *cache.Cache
+	peeker  peeker.Peeker
+	namer   func() string
+	metrics *metrics.Route
 
 	clients  chan *client.Client
 	requests chan client.Request
+	// feedback is the provider passed to Feed, if it wants to be told how its mirrors perform.
+	feedback types.FeedbackReceiver
+	provider struct {
+		sync.Mutex
+		types.Provider
+	}
+
+	// done is closed when the pool is shutting down. running tracks the goroutines that need to finish before Close
+	// returns.
+	done      chan struct{}
+	closeOnce sync.Once
+	running   sync.WaitGroup
+
+	workers    registry
+	quarantine quarantine
+	freshness  freshness
+	stickiness stickiness
+	bans       struct {
+		sync.Mutex
+		mirrors map[string]bool
+	}
 }
 
 type Config struct {
+	// Name identifies the pool in logs and metrics. It is set by server.Server to the name of the route it serves.
+	Name string `yaml:"-"`
+
 	// Retries controls how many times a request is re-enqueued after a retryable error occurs.
-	// Errors are considered retryable if they occur before writing anything to the client.
+	// Errors are considered retryable if they occur before writing anything to the client. Retries of the segments of a
+	// segmented download count against the same budget.
 	Retries int `yaml:"retries"`
 	// Workers is the amount of workers that will serve requests in parallel. It should be higher that the amount of
 	// expected connections to refractor, otherwise requests will be serialized.
@@ -39,135 +75,596 @@ type Config struct {
 	PeekSizeMiBs int64 `yaml:"peekSizeMiBs"`
 	// PeekTimeout is the amount of time to give for PeekSizeBytes to be read before switching to another mirror.
 	PeekTimeout time.Duration `yaml:"peekTimeout"`
+
+	// SegmentThresholdMiBs enables segmented downloads for files larger than this size. The rest of the file after
+	// the first segment is downloaded in byte ranges from several workers in parallel. Zero disables segmentation.
+	SegmentThresholdMiBs int64 `yaml:"segmentThresholdMiBs"`
+	// SegmentSizeMiBs is the size of each of the segments. Segments are held in memory until they can be written to
+	// the client, in order.
+	SegmentSizeMiBs int64 `yaml:"segmentSizeMiBs"`
+	// ParallelSegments is the maximum number of segments of a file being downloaded at the same time.
+	ParallelSegments int `yaml:"parallelSegments"`
+
+	// Redirect makes the pool answer requests with a redirect to the mirror of the best ranked worker, instead of
+	// proxying them. Requests are proxied if no worker has been ranked yet, or if they are served from the cache.
+	Redirect bool `yaml:"redirect"`
+	// RedirectSampleRatio is the fraction of requests, between 0 and 1, that are still proxied in redirect mode so the
+	// performance of the workers keeps being measured.
+	RedirectSampleRatio float64 `yaml:"redirectSampleRatio"`
+
+	// MirrorPolicy controls how many workers can be bound to the same mirror at the same time. It can be one of:
+	//   - unique: Only one worker can be bound to each mirror, even if it is reached through different schemes. This is
+	//     the default.
+	//   - perHost: Up to MaxWorkersPerHost workers can be bound to mirrors in the same host. MaxWorkersPerHost defaults
+	//     to 1.
+	//   - any: Mirrors are not checked for duplicates.
+	MirrorPolicy      string `yaml:"mirrorPolicy"`
+	MaxWorkersPerHost int    `yaml:"maxWorkersPerHost"`
+
+	// MaxMirrorLag is the maximum time a mirror can lag behind the most up-to-date mirror seen by the pool. Mirrors are
+	// only checked if the provider implements types.FreshnessChecker. It defaults to 12h, and a negative value disables
+	// the check.
+	MaxMirrorLag time.Duration `yaml:"maxMirrorLag"`
+
+	// StickyWindow enables sending the repository databases requested by a client to the same mirror, or to mirrors
+	// updated at the same time, for this long after the first one is downloaded. This prevents a sync session from
+	// getting databases from mirrors with different contents. Clients are identified by their IP address.
+	StickyWindow time.Duration `yaml:"stickyWindow"`
+
+	// HedgeSizeKiBs enables hedging requests for small files, which are sent to two different workers at once. The first
+	// response whose body is peeked successfully is served, and the other one is cancelled. Repository databases are
+	// always hedged, as well as requests for ranges no larger than this size. Other files are not, as their size is not
+	// known before requesting them. Zero disables hedging.
+	HedgeSizeKiBs int64 `yaml:"hedgeSizeKiBs"`
+
+	// Quarantine is the time a mirror is kept out of the pool after a worker bound to it is evicted. It doubles each
+	// time the mirror is evicted again, up to MaxQuarantine. They default to 1m and 1h, and a negative Quarantine
+	// disables quarantine.
+	Quarantine    time.Duration `yaml:"quarantine"`
+	MaxQuarantine time.Duration `yaml:"maxQuarantine"`
+}
+
+// WithDefaults returns a copy of c with defaults applied to unset fields. Fields disabled with a negative value are set
+// to zero.
+func (c Config) WithDefaults() Config {
+	if c.MirrorPolicy == "" {
+		c.MirrorPolicy = MirrorPolicyUnique
+	}
+
+	if c.MirrorPolicy == MirrorPolicyPerHost && c.MaxWorkersPerHost == 0 {
+		c.MaxWorkersPerHost = 1
+	}
+
+	switch {
+	case c.MaxMirrorLag == 0:
+		c.MaxMirrorLag = defaultMaxMirrorLag
+	case c.MaxMirrorLag < 0:
+		c.MaxMirrorLag = 0
+	}
+
+	switch {
+	case c.Quarantine == 0:
+		c.Quarantine = defaultQuarantine
+	case c.Quarantine < 0:
+		c.Quarantine = 0
+	}
+
+	if c.MaxQuarantine == 0 {
+		c.MaxQuarantine = defaultMaxQuarantine
+	}
+
+	return c
+}
+
+// Validate returns an error if c selects an unknown mirror policy.
+func (c Config) Validate() error {
+	c = c.WithDefaults()
+
+	switch c.MirrorPolicy {
+	case MirrorPolicyUnique, MirrorPolicyPerHost, MirrorPolicyAny:
+		return nil
+	default:
+		return fmt.Errorf("unknown mirror policy %q", c.MirrorPolicy)
+	}
 }
 
-func New(config Config, stats *stats.Stats) *Pool {
-	return &Pool{
+// New creates a new pool. cache is optional, and can be nil.
+func New(config Config, stats *stats.Stats, cache *cache.Cache) *Pool {
+	config = config.WithDefaults()
+
+	p := &Pool{
 		Config:   config,
 		stats:    stats,
+		cache:    cache,
 		namer:    names.Haiku,
+		metrics:  metrics.ForRoute(config.Name),
 		clients:  make(chan *client.Client),
 		requests: make(chan client.Request),
+		done:     make(chan struct{}),
 		peeker: peeker.Peeker{
 			SizeBytes: config.PeekSizeMiBs * 1024 * 1024,
 			Timeout:   config.PeekTimeout,
 		},
 	}
+	p.bans.mirrors = map[string]bool{}
+
+	return p
 }
 
+// Feed starts adding mirrors returned by provider to the pool as workers need them, until the pool is closed.
 func (p *Pool) Feed(provider types.Provider) {
+	// Workers read feedback after receiving a client from feed, so it is set before any is sent.
+	p.feedback, _ = provider.(types.FeedbackReceiver)
+	p.setProvider(provider)
+
+	p.running.Add(1)
+	go p.feed(provider)
+}
+
+func (p *Pool) feed(provider types.Provider) {
+	defer p.running.Done()
+
+	checker, _ := provider.(types.FreshnessChecker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	log.Infof("Starting to feed mirrors to the pool")
+	for _, url := range p.stats.Preferred(p.Workers) {
+		if rejection := p.reject(checker, url); rejection != "" {
+			log.Debugf("Skipping historically fast mirror %s, %s", url, rejection)
+			continue
+		}
+
+		log.Infof("Feeding historically fast mirror %s", url)
+		select {
+		case p.clients <- client.NewClient(client.Config{}, url):
+		case <-p.done:
+			return
+		}
+	}
+
+	redraws := 0
 	for {
-		url, err := provider.Mirror()
+		mirror, err := types.Next(ctx, provider)
+		if ctx.Err() != nil {
+			log.Infof("Stopped feeding mirrors to the pool")
+			return
+		}
 		if err != nil {
 			log.Errorf("Provided returned an error: %v", err)
-			time.Sleep(10 * time.Second)
+			p.metrics.ProviderErrors.Inc()
+			select {
+			case <-time.After(10 * time.Second):
+			case <-p.done:
+				return
+			}
+			continue
+		}
+
+		url := mirror.URL
+		if rejection := p.reject(checker, url); rejection != "" {
+			log.Debugf("Skipping mirror %s, %s", url, rejection)
+			redraws++
+			if redraws%maxRedraws == 0 {
+				// The provider seems to be running out of mirrors, give some time for workers to leave the pool and
+				// for quarantines to expire.
+				if redraws == maxRedraws {
+					log.Warnf("Provider returned %d unusable mirrors in a row, it might not have enough mirrors", redraws)
+				}
+				select {
+				case <-time.After(time.Second):
+				case <-p.done:
+					return
+				}
+			}
+			continue
+		}
+		redraws = 0
+
+		log.Infof("Feeding mirror %s", mirror)
+		p.stats.Describe(mirror)
+		select {
+		case p.clients <- client.NewClient(client.Config{}, url):
+		case <-p.done:
+			log.Infof("Stopped feeding mirrors to the pool")
+			return
 		}
-		p.clients <- client.NewClient(client.Config{}, url)
 	}
 }
 
+// reject returns why mirror cannot be added to the pool, or an empty string if it can. checker is optional, and can be
+// nil.
+func (p *Pool) reject(checker types.FreshnessChecker, mirror string) string {
+	switch {
+	case p.Banned(mirror):
+		return "banned"
+	case p.quarantine.quarantined(mirror):
+		return "quarantined"
+	case p.stats.RecentlyEvicted(mirror):
+		return "evicted recently"
+	case !p.admits(mirror, p.workers.mirrors()):
+		return "already in use"
+	case checker != nil && p.MaxMirrorLag > 0:
+		if err := p.checkFreshness(checker, mirror); err != nil {
+			log.Warnf("Rejecting mirror %s: %v", mirror, err)
+			if p.Quarantine > 0 {
+				p.quarantine.add(mirror, reasonOutdated, p.Quarantine, p.MaxQuarantine)
+			}
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+// Run starts the goroutines that manage the workers of the pool, which run until the pool is closed.
 func (p *Pool) Run() {
 	for i := 0; i < p.Workers; i++ {
 		log.Debugf("Starting worker manager thread #%d", i)
+		p.running.Add(1)
 		go p.work()
 	}
 }
 
+// Close stops the workers and the feeding of mirrors, and waits for them to finish. Close should be called once
+// requests are no longer being served, as the pool cannot serve them afterwards.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	p.running.Wait()
+}
+
 func (p *Pool) work() {
-	for cli := range p.clients {
-		worker := worker.Worker{
-			Client: cli,
-			Stats:  p.stats,
-			Name:   p.namer(),
+	defer p.running.Done()
+
+	for {
+		var cli *client.Client
+		select {
+		case cli = <-p.clients:
+		case <-p.done:
+			return
+		}
+
+		evict := make(chan struct{})
+		direct := make(chan client.Request)
+		w := worker.Worker{
+			Client:  cli,
+			Stats:   p.stats,
+			Name:    p.namer(),
+			Evict:   evict,
+			Direct:  direct,
+			Stop:    p.done,
+			Metrics: p.metrics,
+		}
+		if p.feedback != nil {
+			w.OnSample = func(sample stats.Sample) {
+				p.feedback.Sampled(cli.String(), types.Sample(sample))
+			}
+		}
+		if !p.workers.add(w, evict, direct, func(bound []string) bool { return p.admits(cli.String(), bound) }) {
+			// Another worker was bound to the same mirror after feed checked it.
+			log.Debugf("Discarding duplicated mirror %s", cli.String())
+			continue
+		}
+
+		err := w.Work(p.requests)
+		p.workers.remove(w.String())
+		if err == nil {
+			// The pool is shutting down. Stats are kept, as they are still valid.
+			return
+		}
+
+		log.Error(err)
+		p.stats.Remove(w.String())
+		p.stats.Evicted(cli.String())
+
+		reason := metrics.EvictionError
+		var eviction *worker.Eviction
+		if errors.As(err, &eviction) {
+			reason = eviction.Reason
+		}
+
+		if p.feedback != nil {
+			p.feedback.Evicted(cli.String(), reason)
+		}
+
+		if p.Quarantine > 0 && eviction != nil {
+			info := p.quarantine.add(cli.String(), eviction.Reason, p.Quarantine, p.MaxQuarantine)
+			log.Infof("Quarantining %s for %s (strike %d)", cli.String(), time.Until(info.Until).Round(time.Second), info.Strikes)
 		}
-		log.Error(worker.Work(p.requests))
-		p.stats.Remove(worker.String())
 	}
 }
 
 func (p *Pool) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	retries := 0
+	if p.cache != nil && cache.Classify(r.URL.Path) == cache.Immutable && p.serveCached(rw, r) {
+		return
+	}
+
+	if p.shouldRedirect(r) && p.redirect(rw, r) {
+		return
+	}
+
+	t := newTransfer(rw, r, p.metrics.ServedBytes.WithLabelValues(metrics.SourceMirror))
 	for {
-		if retries > p.Config.Retries {
-			log.Errorf("Max retries for %s exhausted", r.URL.Path)
-			rw.WriteHeader(http.StatusInternalServerError)
+		err, retryable := p.tryRequest(t)
+		if err == nil {
+			t.commit()
 			return
 		}
 
-		err, retryable := p.tryRequest(r, rw)
-		if err == nil {
+		if r.Context().Err() != nil {
+			log.Infof("Client went away while serving %s: %v", r.URL.Path, err)
+			t.abort()
 			return
 		}
 
 		log.Errorf("%v", err)
 		if !retryable {
+			t.abort()
 			return
 		}
 
-		log.Warnf("Retrying %s", r.URL.Path)
-		retries++
+		if t.retry() > p.Config.Retries {
+			log.Errorf("Max retries for %s exhausted", r.URL.Path)
+			p.metrics.RetriesExhausted.Inc()
+			if !t.headerWritten {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+			t.abort()
+			return
+		}
+
+		if t.headerWritten {
+			log.Warnf("Resuming %s from byte %d", r.URL.Path, t.offset())
+		} else {
+			log.Warnf("Retrying %s", r.URL.Path)
+		}
+		p.metrics.Retries.Inc()
 	}
 }
 
-func (p *Pool) tryRequest(r *http.Request, rw http.ResponseWriter) (error, bool) {
+func (p *Pool) tryRequest(t *transfer) (error, bool) {
+	r := t.r
 	responseChan := make(chan client.Response)
 	request := client.Request{
+		Context:      r.Context(),
 		Path:         r.URL.Path,
 		ResponseChan: responseChan,
-		Header:       r.Header,
+		Header:       t.header(),
+	}
+
+	revalidating := false
+	if p.cache != nil && !t.headerWritten && cache.Classify(r.URL.Path) == cache.Revalidate {
+		if modTime, found := p.cache.ModTime(r.URL.Path); found {
+			// Ask the mirror whether our copy is still valid. Conditional headers sent by the client are evaluated
+			// later against the cached copy by cache.Serve.
+			request.Header = r.Header.Clone()
+			request.Header.Del("If-None-Match")
+			request.Header.Set("If-Modified-Since", modTime.UTC().Format(http.TimeFormat))
+			revalidating = true
+		}
 	}
 
 	log.Debugf("Dispatching request %s to workers", request.Path)
-	p.requests <- request
-	response := <-responseChan
+	clientKey, sticky := p.sticky(r)
+	var response client.Response
+	switch {
+	case sticky:
+		response = p.dispatchSticky(clientKey, request)
+	case p.hedged(t):
+		var cancel context.CancelFunc
+		response, cancel = p.dispatchHedged(request)
+		defer cancel()
+	default:
+		response = p.dispatch(request)
+	}
 	if response.Error != nil {
 		return fmt.Errorf("%s%s errored: %w", response.Worker, request.Path, response.Error), true
 	}
 
-	if response.HTTPResponse.StatusCode >= 400 {
+	done := p.workers.track(response.Worker, request.Path)
+	defer done()
+
+	status := response.HTTPResponse.StatusCode
+	if status >= 400 && !(status == http.StatusRequestedRangeNotSatisfiable && t.ranged && !t.headerWritten) {
 		// TODO: Hack: Archlinux mirrors are somehow expected to return 404 for .sig files.
 		// For this reason, we do not attempt to retry 404s for .sig files.
-		if !strings.HasSuffix(r.URL.Path, ".db.sig") {
-			return fmt.Errorf("%s%s returned non-200 status: %d", response.Worker, request.Path, response.HTTPResponse.StatusCode), true
+		if !strings.HasSuffix(r.URL.Path, ".db.sig") || t.headerWritten {
+			response.HTTPResponse.Body.Close()
+			return fmt.Errorf("%s%s returned non-200 status: %d", response.Worker, request.Path, status), true
 		}
 	}
 
-	written, err := p.writeResponse(response.HTTPResponse, rw)
-	response.Done(written)
+	if sticky && status < 400 {
+		p.bindSticky(clientKey, response.Worker)
+	}
+
+	if revalidating && status == http.StatusNotModified {
+		response.HTTPResponse.Body.Close()
+		response.Done(0, nil)
+
+		if !p.serveCached(t.rw, r) {
+			return fmt.Errorf("%s was removed from cache while being revalidated", request.Path), true
+		}
+
+		return nil, false
+	}
+
+	skip, err := t.prepare(response.HTTPResponse)
+	if err != nil {
+		response.HTTPResponse.Body.Close()
+		response.Done(0, nil)
+		return fmt.Errorf("%s%s cannot resume transfer: %w", response.Worker, request.Path, err), true
+	}
+
+	// If the file is to be segmented, this response is only used for the first segment.
+	limit := int64(-1)
+	segmented := p.segmented(t)
+	if segmented {
+		limit = p.SegmentSizeMiBs * 1024 * 1024
+	}
+
+	body := &countingReader{Reader: response.HTTPResponse.Body}
+	err = p.writeResponse(t, response.HTTPResponse, body, skip, limit)
+	response.HTTPResponse.Body.Close()
+
+	if err != nil && r.Context().Err() != nil {
+		// The peeker might still be reading from body, so we cannot look into it.
+		response.Done(0, nil)
+		return fmt.Errorf("%s%s: client went away: %w", response.Worker, request.Path, err), false
+	}
+
+	if errors.Is(err, peeker.ErrPeekTimeout) {
+		// The peeker might still be reading from body, so we cannot look into it.
+		p.metrics.PeekTimeouts.Inc()
+		response.Done(0, nil)
+		return fmt.Errorf("%s%s: %w", response.Worker, request.Path, err), !t.headerWritten || t.resumable()
+	}
+
+	response.Done(body.read, body.err)
+
+	if body.err != nil {
+		// The mirror failed, but we can try to get the rest of the file from another one.
+		err = fmt.Errorf("reading %s%s from mirror: %w", response.Worker, request.Path, body.err)
+		return err, !t.headerWritten || t.resumable()
+	}
 
 	if err != nil {
 		err = fmt.Errorf("writing %s%s to client: %w", response.Worker, request.Path, err)
-		return err, written == 0
+		return err, !t.headerWritten
+	}
+
+	if segmented && t.remaining() > 0 {
+		return p.writeSegments(t)
 	}
 
 	return nil, false
 }
 
-func (p *Pool) writeResponse(response *http.Response, rw http.ResponseWriter) (int64, error) {
+// dispatch sends request to the workers and waits for the response. If the context of the request is done before
+// that, a response containing its error is returned.
+func (p *Pool) dispatch(request client.Request) client.Response {
+	start := time.Now()
+	select {
+	case p.requests <- request:
+	case <-request.Context.Done():
+		return client.Response{Error: request.Context.Err()}
+	}
+	p.metrics.QueueWait.Observe(time.Since(start).Seconds())
+
+	return awaitResponse(request)
+}
+
+// awaitResponse waits for the response to a dispatched request. If the context of the request is done before that, a
+// response containing its error is returned.
+func awaitResponse(request client.Request) client.Response {
+	select {
+	case response := <-request.ResponseChan:
+		return response
+	case <-request.Context.Done():
+		return client.Response{Error: request.Context.Err()}
+	}
+}
+
+// serveCached serves r from the cache, if it is present there.
+func (p *Pool) serveCached(rw http.ResponseWriter, r *http.Request) bool {
+	crw := &countingResponseWriter{ResponseWriter: rw}
+	if !p.cache.Serve(crw, r) {
+		return false
+	}
+
+	p.metrics.ServedBytes.WithLabelValues(metrics.SourceCache).Add(float64(crw.written))
+	return true
+}
+
+// cacheWriter returns a cache.Writer where a copy of response should be written, or nil if it should not be cached.
+func (p *Pool) cacheWriter(r *http.Request, response *http.Response) *cache.Writer {
+	if p.cache == nil || r.Method != http.MethodGet || response.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	if cache.Classify(r.URL.Path) == cache.Uncacheable {
+		return nil
+	}
+
+	modTime, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Now()
+	}
+
+	fill, err := p.cache.Writer(r.URL.Path, response.ContentLength, modTime)
+	if err != nil {
+		log.Warnf("Not caching %s: %v", r.URL.Path, err)
+		return nil
+	}
+
+	return fill
+}
+
+// writeResponse writes body, read from response, to the client after discarding the first skip bytes. If limit is not
+// negative, at most limit bytes are written.
+// Status and headers are only written if this is the first response written for the transfer.
+// Errors reading body are recorded by the countingReader, and should be checked by the caller.
+func (p *Pool) writeResponse(t *transfer, response *http.Response, body *countingReader, skip, limit int64) error {
 	// Peek body before writing headers
-	peeked, err := p.peeker.Peek(response.Body)
-	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
-		return 0, fmt.Errorf("peeking response body: %w", err)
+	peeked, err := p.peeker.PeekContext(t.r.Context(), body)
+	if errors.Is(err, peeker.ErrPeekTimeout) {
+		return fmt.Errorf("peeking response body: %w", err)
+	}
+
+	if err != nil && t.r.Context().Err() != nil {
+		return fmt.Errorf("peeking response body: %w", err)
+	}
+
+	if !t.headerWritten {
+		for header, values := range response.Header {
+			for _, value := range values {
+				t.rw.Header().Add(header, value)
+			}
+		}
+
+		t.rw.WriteHeader(response.StatusCode)
+		t.headerWritten = true
+		t.fill = p.cacheWriter(t.r, response)
 	}
 
-	for header, values := range response.Header {
-		for _, value := range values {
-			rw.Header().Add(header, value)
+	reader := io.MultiReader(bytes.NewReader(peeked), body)
+	if skip > 0 {
+		_, err = io.CopyN(io.Discard, reader, skip)
+		if err != nil {
+			body.err = fmt.Errorf("skipping %d bytes: %w", skip, err)
+			return body.err
 		}
 	}
 
-	rw.WriteHeader(response.StatusCode)
-	peekedWritten, err := rw.Write(peeked)
-	if err != nil {
-		return int64(peekedWritten), fmt.Errorf("writing peeked body: %w", err)
+	want := t.remaining()
+	if limit >= 0 && (want < 0 || limit < want) {
+		want = limit
 	}
 
-	restWritten, err := io.Copy(rw, response.Body)
-	written := int64(peekedWritten) + restWritten
+	if want >= 0 {
+		reader = io.LimitReader(reader, want)
+	}
+
+	written, err := io.Copy(t, reader)
 	if err != nil {
-		return written, fmt.Errorf("writing body: %w", err)
+		return fmt.Errorf("writing body: %w", err)
+	}
+
+	if want >= 0 && written < want {
+		body.err = fmt.Errorf("mirror closed the connection with %d bytes left: %w", want-written, io.ErrUnexpectedEOF)
+		return body.err
 	}
 
-	return written, nil
+	return nil
 }
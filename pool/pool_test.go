@@ -0,0 +1,872 @@
+package pool_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/provider/types"
+	"roob.re/refractor/stats"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sequenceProvider returns the supplied mirrors in order, repeating the last one.
+type sequenceProvider struct {
+	sync.Mutex
+	mirrors []string
+}
+
+func (sp *sequenceProvider) Mirror() (string, error) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	mirror := sp.mirrors[0]
+	if len(sp.mirrors) > 1 {
+		sp.mirrors = sp.mirrors[1:]
+	}
+
+	return mirror, nil
+}
+
+var content = bytes.Repeat([]byte("0123456789abcdef"), 192*1024)
+
+// goodMirror serves content honoring range requests.
+func goodMirror() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.ServeContent(rw, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+// brokenMirror sends half of content and then drops the connection.
+func brokenMirror() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(content[:len(content)/2])
+		rw.(http.Flusher).Flush()
+
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+}
+
+var defaultConfig = pool.Config{
+	Retries:      3,
+	Workers:      1,
+	PeekSizeMiBs: 0,
+	PeekTimeout:  time.Second,
+}
+
+func newPool(mirrors ...string) *pool.Pool {
+	return newPoolWithConfig(defaultConfig, mirrors...)
+}
+
+func newPoolWithConfig(config pool.Config, mirrors ...string) *pool.Pool {
+	p := pool.New(config, stats.New(stats.Config{NumWorkers: config.Workers}), nil)
+
+	go p.Run()
+	p.Feed(&sequenceProvider{mirrors: mirrors})
+
+	return p
+}
+
+func TestPool_Resumes_Interrupted_Transfers(t *testing.T) {
+	t.Parallel()
+
+	broken := brokenMirror()
+	defer broken.Close()
+	good := goodMirror()
+	defer good.Close()
+
+	p := newPool(broken.URL, good.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Fatalf("resumed body does not match, got %d bytes out of %d", rec.Body.Len(), len(content))
+	}
+}
+
+func TestPool_Serves_Ranges(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		mirrors func() []*httptest.Server
+	}{
+		{name: "From_Good_Mirror", mirrors: func() []*httptest.Server {
+			return []*httptest.Server{goodMirror()}
+		}},
+		{name: "Resuming_From_Broken_Mirror", mirrors: func() []*httptest.Server {
+			return []*httptest.Server{brokenMirror(), goodMirror()}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var urls []string
+			for _, mirror := range tc.mirrors() {
+				defer mirror.Close()
+				urls = append(urls, mirror.URL)
+			}
+
+			p := newPool(urls...)
+
+			const start = 1000
+			req := httptest.NewRequest(http.MethodGet, "/file", nil)
+			req.Header.Set("Range", "bytes="+strconv.Itoa(start)+"-")
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusPartialContent {
+				t.Fatalf("unexpected status %d", rec.Code)
+			}
+
+			if !bytes.Equal(rec.Body.Bytes(), content[start:]) {
+				t.Fatalf("ranged body does not match, got %d bytes out of %d", rec.Body.Len(), len(content)-start)
+			}
+		})
+	}
+}
+
+func TestPool_Downloads_Segments(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	ranges := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+		}
+
+		http.ServeContent(rw, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.SegmentThresholdMiBs = 1
+	config.SegmentSizeMiBs = 1
+	config.ParallelSegments = 2
+
+	p := newPoolWithConfig(config, mirror.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Fatalf("segmented body does not match, got %d bytes out of %d", rec.Body.Len(), len(content))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ranges != 2 {
+		t.Fatalf("expected 2 segments to be requested, got %d", ranges)
+	}
+}
+
+func TestPool_Shares_Retries_With_Segments(t *testing.T) {
+	t.Parallel()
+
+	var ranges int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.ServeContent(rw, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.SegmentThresholdMiBs = 1
+	config.SegmentSizeMiBs = 1
+	config.ParallelSegments = 2
+
+	p := newPoolWithConfig(config, mirror.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	if rec.Body.Len() >= len(content) {
+		t.Fatalf("expected the transfer to be aborted, got %d bytes", rec.Body.Len())
+	}
+
+	// Every failed segment counts against the same budget. One more segment might be in flight when it runs out.
+	if requested := atomic.LoadInt32(&ranges); requested > int32(config.Retries+2) {
+		t.Fatalf("expected at most %d segments to be requested, got %d", config.Retries+2, requested)
+	}
+}
+
+func TestPool_Streams_When_Segments_Are_Not_Supported(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var ranges []string
+	// The mirror ignores range requests, and always sends the whole file.
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			mu.Lock()
+			ranges = append(ranges, rangeHeader)
+			mu.Unlock()
+		}
+
+		rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = rw.Write(content)
+	}))
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.SegmentThresholdMiBs = 1
+	config.SegmentSizeMiBs = 1
+	config.ParallelSegments = 2
+
+	p := newPoolWithConfig(config, mirror.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Fatalf("body does not match, got %d bytes out of %d", rec.Body.Len(), len(content))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, requested := range ranges {
+		if requested == "bytes=1048576-" {
+			return
+		}
+	}
+
+	t.Fatalf("expected the rest of the file to be requested in a single stream, got ranges %v", ranges)
+}
+
+func TestPool_Redirects_To_Best_Mirror(t *testing.T) {
+	t.Parallel()
+
+	mirror := goodMirror()
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Redirect = true
+	p := newPoolWithConfig(config, mirror.URL)
+
+	// Requests are proxied until a worker has been ranked.
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d before ranking", rec.Code)
+	}
+
+	workers := p.ActiveWorkers()
+	if len(workers) != 1 {
+		t.Fatalf("expected 1 active worker, got %d", len(workers))
+	}
+	p.Stats().Update(workers[0].Name, stats.Sample{Bytes: 1024 * 1024, Duration: time.Second})
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("unexpected status %d after ranking", rec.Code)
+	}
+
+	if location := rec.Header().Get("Location"); location != mirror.URL+"/file" {
+		t.Fatalf("unexpected redirect to %q", location)
+	}
+}
+
+func TestPool_Aborts_Cancelled_Requests(t *testing.T) {
+	t.Parallel()
+
+	cancelled := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer mirror.Close()
+
+	p := newPool(mirror.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil).WithContext(ctx))
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request to the mirror was not cancelled")
+	}
+
+	if ranking := p.Stats().Ranking(); len(ranking) != 0 {
+		t.Fatalf("cancelled request was recorded in stats: %v", ranking)
+	}
+}
+
+func TestPool_Closes(t *testing.T) {
+	t.Parallel()
+
+	mirror := goodMirror()
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	p := newPoolWithConfig(config, mirror.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool did not close")
+	}
+
+	if workers := p.ActiveWorkers(); len(workers) != 0 {
+		t.Fatalf("%d workers are still active after closing", len(workers))
+	}
+}
+
+// blockingProvider never returns a mirror.
+type blockingProvider struct{}
+
+func (blockingProvider) Mirror() (string, error) {
+	select {}
+}
+
+func TestPool_Closes_With_Blocked_Provider(t *testing.T) {
+	t.Parallel()
+
+	p := pool.New(defaultConfig, stats.New(stats.Config{NumWorkers: defaultConfig.Workers}), nil)
+	p.Run()
+	p.Feed(blockingProvider{})
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool did not close while the provider was blocked")
+	}
+}
+
+func TestPool_Quarantines_Evicted_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	// A closed server refuses connections, which makes the worker bound to it be evicted.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	good := goodMirror()
+	defer good.Close()
+
+	config := defaultConfig
+	config.Quarantine = time.Minute
+	config.MaxQuarantine = time.Hour
+	p := newPoolWithConfig(config, dead.URL, good.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	quarantined := p.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].Mirror != dead.URL || quarantined[0].Strikes != 1 {
+		t.Fatalf("expected %s to be quarantined once, got %v", dead.URL, quarantined)
+	}
+
+	if until := time.Until(quarantined[0].Until); until < 50*time.Second || until > time.Minute {
+		t.Fatalf("unexpected quarantine of %s", until)
+	}
+
+	for _, worker := range p.ActiveWorkers() {
+		if worker.Mirror == dead.URL {
+			t.Fatalf("quarantined mirror was added to the pool again")
+		}
+	}
+}
+
+func TestConfig_Defaults_Quarantine(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		quarantine time.Duration
+		expected   time.Duration
+	}{
+		{name: "Unset", quarantine: 0, expected: time.Minute},
+		{name: "Set", quarantine: 5 * time.Minute, expected: 5 * time.Minute},
+		{name: "Disabled", quarantine: -1, expected: 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := defaultConfig
+			config.Quarantine = tc.quarantine
+			p := pool.New(config, stats.New(stats.Config{NumWorkers: config.Workers}), nil)
+			if p.Quarantine != tc.expected {
+				t.Fatalf("expected quarantine of %s, got %s", tc.expected, p.Quarantine)
+			}
+		})
+	}
+}
+
+func TestPool_Does_Not_Quarantine_When_Disabled(t *testing.T) {
+	t.Parallel()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	good := goodMirror()
+	defer good.Close()
+
+	config := defaultConfig
+	config.Quarantine = -1
+	p := newPoolWithConfig(config, dead.URL, good.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if quarantined := p.Quarantined(); len(quarantined) != 0 {
+		t.Fatalf("expected no mirror to be quarantined, got %v", quarantined)
+	}
+}
+
+func TestPool_Skips_Recently_Evicted_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	var evictedHits int32
+	evicted := countingMirror(&evictedHits)
+	defer evicted.Close()
+	good := goodMirror()
+	defer good.Close()
+
+	st := stats.New(stats.Config{NumWorkers: defaultConfig.Workers})
+	st.Evicted(evicted.URL)
+
+	p := pool.New(defaultConfig, st, nil)
+	p.Run()
+	p.Feed(&sequenceProvider{mirrors: []string{evicted.URL, good.URL}})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if hits := atomic.LoadInt32(&evictedHits); hits != 0 {
+		t.Fatalf("recently evicted mirror was added to the pool and got %d requests", hits)
+	}
+}
+
+// countingProvider always returns the same mirror, and counts how many times it has been asked for one.
+type countingProvider struct {
+	mirror string
+	calls  int32
+}
+
+func (cp *countingProvider) Mirror() (string, error) {
+	atomic.AddInt32(&cp.calls, 1)
+	return cp.mirror, nil
+}
+
+func TestPool_Backs_Off_From_Banned_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	mirror := goodMirror()
+	defer mirror.Close()
+
+	p := pool.New(defaultConfig, stats.New(stats.Config{NumWorkers: defaultConfig.Workers}), nil)
+	p.Ban(mirror.URL)
+
+	provider := &countingProvider{mirror: mirror.URL}
+	p.Run()
+	p.Feed(provider)
+	defer p.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	// feed waits a second after every maxRedraws unusable mirrors in a row.
+	if calls := atomic.LoadInt32(&provider.calls); calls > 60 {
+		t.Fatalf("expected feed to back off from the banned mirror, but it was asked for %d mirrors", calls)
+	}
+}
+
+func TestPool_Rejects_Duplicated_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	mirror := goodMirror()
+	defer mirror.Close()
+
+	config := defaultConfig
+	config.Workers = 3
+	config.MirrorPolicy = pool.MirrorPolicyUnique
+	// The same mirror reached over https must be considered a duplicate as well.
+	p := newPoolWithConfig(config, mirror.URL, strings.Replace(mirror.URL, "http://", "https://", 1), mirror.URL)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if workers := p.ActiveWorkers(); len(workers) != 1 {
+		t.Fatalf("expected 1 worker bound to the mirror, got %d", len(workers))
+	}
+}
+
+// freshnessProvider is a sequenceProvider whose mirrors report the given last update times.
+type freshnessProvider struct {
+	sequenceProvider
+	updates map[string]time.Time
+}
+
+func (fp *freshnessProvider) LastUpdate(_ context.Context, mirror string) (time.Time, error) {
+	return fp.updates[mirror], nil
+}
+
+func TestPool_Rejects_Outdated_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	fresh := goodMirror()
+	defer fresh.Close()
+	stale := goodMirror()
+	defer stale.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.MaxMirrorLag = time.Hour
+	config.Quarantine = time.Minute
+
+	p := pool.New(config, stats.New(stats.Config{NumWorkers: config.Workers}), nil)
+	go p.Run()
+	p.Feed(&freshnessProvider{
+		sequenceProvider: sequenceProvider{mirrors: []string{fresh.URL, stale.URL, fresh.URL}},
+		updates: map[string]time.Time{
+			fresh.URL: time.Now(),
+			stale.URL: time.Now().Add(-2 * time.Hour),
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	for _, worker := range p.ActiveWorkers() {
+		if worker.Mirror == stale.URL {
+			t.Fatalf("outdated mirror was added to the pool")
+		}
+	}
+
+	quarantined := p.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].Mirror != stale.URL || quarantined[0].Reason != "outdated" {
+		t.Fatalf("expected %s to be quarantined for being outdated, got %v", stale.URL, quarantined)
+	}
+}
+
+func TestPool_Skips_Freshness_Check_When_Disabled(t *testing.T) {
+	t.Parallel()
+
+	stale := goodMirror()
+	defer stale.Close()
+
+	config := defaultConfig
+	config.MaxMirrorLag = -1
+	p := pool.New(config, stats.New(stats.Config{NumWorkers: config.Workers}), nil)
+	if p.MaxMirrorLag != 0 {
+		t.Fatalf("expected the freshness check to be disabled, got a maximum lag of %s", p.MaxMirrorLag)
+	}
+
+	go p.Run()
+	p.Feed(&freshnessProvider{
+		sequenceProvider: sequenceProvider{mirrors: []string{stale.URL}},
+		updates:          map[string]time.Time{stale.URL: time.Now().Add(-48 * time.Hour)},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+}
+
+// countingMirror is a goodMirror that counts the requests it receives.
+func countingMirror(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		http.ServeContent(rw, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestPool_Sticks_Databases_To_Mirror(t *testing.T) {
+	t.Parallel()
+
+	var firstHits, secondHits int32
+	first := countingMirror(&firstHits)
+	defer first.Close()
+	second := countingMirror(&secondHits)
+	defer second.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.StickyWindow = time.Minute
+	p := newPoolWithConfig(config, first.URL, second.URL)
+
+	for len(p.ActiveWorkers()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const requests = 6
+	for _, path := range []string{"/core/os/x86_64/core.db", "/extra/os/x86_64/extra.db"} {
+		for i := 0; i < requests/2; i++ {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rec.Code)
+			}
+		}
+	}
+
+	if atomic.LoadInt32(&firstHits) != requests && atomic.LoadInt32(&secondHits) != requests {
+		t.Fatalf("databases were downloaded from different mirrors: %d and %d", firstHits, secondHits)
+	}
+}
+
+// slowMirror is a goodMirror that takes delay to answer requests.
+func slowMirror(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		http.ServeContent(rw, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestPool_Hedges_Small_Files(t *testing.T) {
+	t.Parallel()
+
+	slow := slowMirror(2 * time.Second)
+	defer slow.Close()
+	fast := goodMirror()
+	defer fast.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.HedgeSizeKiBs = 64
+	p := newPoolWithConfig(config, slow.URL, fast.URL)
+
+	for len(p.ActiveWorkers()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/core/os/x86_64/core.db", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("hedged request took %s, slow mirror was not hedged", elapsed)
+		}
+	}
+
+	// Losing the race must not get the slow mirror evicted.
+	time.Sleep(100 * time.Millisecond)
+	if workers := p.ActiveWorkers(); len(workers) != 2 {
+		t.Fatalf("expected 2 active workers, got %d", len(workers))
+	}
+}
+
+// trickleReader is a bytes.Reader that waits before every read, so the body is streamed slowly.
+type trickleReader struct {
+	*bytes.Reader
+}
+
+func (tr trickleReader) Read(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	return tr.Reader.Read(p)
+}
+
+// trickleMirror is a countingMirror that streams content slowly, after waiting for delay.
+func trickleMirror(hits *int32, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		http.ServeContent(rw, r, "file", time.Time{}, trickleReader{Reader: bytes.NewReader(content)})
+	}))
+}
+
+func TestPool_Hedges_Streamed_Files(t *testing.T) {
+	t.Parallel()
+
+	var fastHits, slowHits int32
+	fast := trickleMirror(&fastHits, 0)
+	defer fast.Close()
+	slow := trickleMirror(&slowHits, 2*time.Second)
+	defer slow.Close()
+
+	config := defaultConfig
+	config.Workers = 2
+	config.HedgeSizeKiBs = 64
+	p := newPoolWithConfig(config, fast.URL, slow.URL)
+
+	for len(p.ActiveWorkers()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/core/os/x86_64/core.db", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if rec.Body.Len() != len(content) {
+		t.Fatalf("expected %d bytes, got %d", len(content), rec.Body.Len())
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("hedged request took %s, it was not served by the fast mirror", elapsed)
+	}
+
+	if hits := atomic.LoadInt32(&fastHits); hits != 1 {
+		t.Fatalf("expected the fast mirror to be requested once, got %d requests", hits)
+	}
+
+	if hits := atomic.LoadInt32(&slowHits); hits != 1 {
+		t.Fatalf("expected both copies to go to different mirrors, slow mirror got %d requests", hits)
+	}
+
+	// Samples are recorded asynchronously.
+	deadline := time.Now().Add(time.Second)
+	for {
+		sampled := false
+		for _, entry := range p.Stats().Ranking() {
+			if strings.HasSuffix(entry.Name, ":"+fast.URL) && entry.Samples > 0 {
+				sampled = true
+			}
+		}
+
+		if sampled {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("sample of the winning mirror was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// metadataProvider returns a single mirror along with its metadata.
+type metadataProvider struct {
+	mirror types.Mirror
+}
+
+func (mp metadataProvider) Mirror() (string, error) {
+	return mp.mirror.URL, nil
+}
+
+func (mp metadataProvider) MirrorContext(_ context.Context) (types.Mirror, error) {
+	return mp.mirror, nil
+}
+
+func (mp metadataProvider) Mirrors(_ context.Context) ([]types.Mirror, error) {
+	return []types.Mirror{mp.mirror}, nil
+}
+
+func TestPool_Records_Mirror_Metadata(t *testing.T) {
+	t.Parallel()
+
+	mirror := goodMirror()
+	defer mirror.Close()
+
+	meta := types.Mirror{URL: mirror.URL, Country: "ES", Score: 1.5, Protocol: "http"}
+	p := pool.New(defaultConfig, stats.New(stats.Config{NumWorkers: defaultConfig.Workers}), nil)
+	go p.Run()
+	p.Feed(metadataProvider{mirror: meta})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if recorded, found := p.Stats().Metadata(mirror.URL); !found || recorded != meta {
+		t.Fatalf("expected metadata %v to be recorded, got %v", meta, recorded)
+	}
+
+	candidates, err := p.Candidates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(candidates) != 1 || candidates[0] != meta {
+		t.Fatalf("unexpected candidates %v", candidates)
+	}
+}
@@ -0,0 +1,113 @@
+package pool
+
+import (
+	"golang.org/x/exp/slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuarantine    = time.Minute
+	defaultMaxQuarantine = time.Hour
+)
+
+// QuarantineInfo describes a mirror that is not allowed back in the pool until some time has passed.
+type QuarantineInfo struct {
+	Mirror string `json:"mirror"`
+	// Reason is the reason why the mirror was last quarantined, either one of metrics.Eviction* reasons or "outdated".
+	Reason string `json:"reason"`
+	// Strikes is the number of times the mirror has been quarantined in a row.
+	Strikes int       `json:"strikes"`
+	Until   time.Time `json:"until"`
+}
+
+// quarantine keeps track of evicted mirrors, which are kept out of the pool for a cooldown that doubles every time they
+// are evicted again.
+type quarantine struct {
+	sync.Mutex
+	mirrors map[string]*QuarantineInfo
+}
+
+// add quarantines mirror for the given reason. The cooldown starts at base, and doubles with each strike up to max.
+// Strikes are forgotten if the mirror has not been quarantined again for max after the last one expired.
+func (q *quarantine) add(mirror, reason string, base, max time.Duration) QuarantineInfo {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.mirrors == nil {
+		q.mirrors = map[string]*QuarantineInfo{}
+	}
+
+	if max < base {
+		max = base
+	}
+
+	now := time.Now()
+	info, found := q.mirrors[mirror]
+	if !found || now.Sub(info.Until) > max {
+		info = &QuarantineInfo{Mirror: mirror}
+		q.mirrors[mirror] = info
+	}
+
+	cooldown := base
+	for i := 0; i < info.Strikes && cooldown < max; i++ {
+		cooldown *= 2
+	}
+	if cooldown > max {
+		cooldown = max
+	}
+
+	info.Strikes++
+	info.Reason = reason
+	info.Until = now.Add(cooldown)
+
+	return *info
+}
+
+// quarantined returns whether mirror is still in its cooldown.
+func (q *quarantine) quarantined(mirror string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	info, found := q.mirrors[mirror]
+	return found && time.Now().Before(info.Until)
+}
+
+// release lifts the quarantine of mirror, and forgets its strikes.
+func (q *quarantine) release(mirror string) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.mirrors, mirror)
+}
+
+func (q *quarantine) list() []QuarantineInfo {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	infos := make([]QuarantineInfo, 0, len(q.mirrors))
+	for _, info := range q.mirrors {
+		if !now.Before(info.Until) {
+			continue
+		}
+
+		infos = append(infos, *info)
+	}
+
+	slices.SortFunc(infos, func(a, b QuarantineInfo) bool {
+		return a.Until.Before(b.Until)
+	})
+
+	return infos
+}
+
+// Quarantined returns the mirrors that are currently quarantined, sorted by the time their quarantine ends.
+func (p *Pool) Quarantined() []QuarantineInfo {
+	return p.quarantine.list()
+}
+
+// Release lets a quarantined mirror back in the pool.
+func (p *Pool) Release(mirror string) {
+	p.quarantine.release(mirror)
+}
@@ -0,0 +1,40 @@
+package pool
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+)
+
+// shouldRedirect returns whether r should be answered with a redirect to a mirror rather than proxied. A fraction of
+// the requests, RedirectSampleRatio, is still proxied so the throughput of the workers keeps being measured.
+func (p *Pool) shouldRedirect(r *http.Request) bool {
+	if !p.Redirect || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	return rand.Float64() >= p.RedirectSampleRatio
+}
+
+// redirect answers r with a redirect to the mirror of the best ranked worker. It returns false without writing
+// anything to rw if no worker has been ranked yet.
+func (p *Pool) redirect(rw http.ResponseWriter, r *http.Request) bool {
+	for _, entry := range p.stats.Ranking() {
+		url, found := p.workers.url(entry.Name, r.URL.Path)
+		if !found {
+			continue
+		}
+
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+
+		log.Debugf("Redirecting %s to %s", r.URL.Path, url)
+		http.Redirect(rw, r, url, http.StatusFound)
+		p.metrics.Redirects.Inc()
+		return true
+	}
+
+	log.Debugf("No ranked workers to redirect %s to, proxying it instead", r.URL.Path)
+	return false
+}
@@ -0,0 +1,182 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"roob.re/refractor/client"
+	"roob.re/refractor/pool/peeker"
+)
+
+// segmented returns whether the rest of the transfer should be downloaded in segments from several workers.
+func (p *Pool) segmented(t *transfer) bool {
+	if p.SegmentThresholdMiBs <= 0 || p.SegmentSizeMiBs <= 0 || t.r.Method != http.MethodGet || !t.resumable() ||
+		t.rangesIgnored {
+		return false
+	}
+
+	return t.remaining() > p.SegmentThresholdMiBs*1024*1024
+}
+
+// errRangeIgnored is returned for segments requested to mirrors that answer with the whole file instead.
+var errRangeIgnored = errors.New("mirror ignored the range request")
+
+type segmentResult struct {
+	buf []byte
+	err error
+}
+
+// writeSegments downloads the rest of the transfer in segments of SegmentSizeMiBs, up to ParallelSegments of them at
+// the same time, and writes them to the client in order. Like tryRequest, it returns whether the error is retryable.
+func (p *Pool) writeSegments(t *transfer) (error, bool) {
+	segmentSize := p.SegmentSizeMiBs * 1024 * 1024
+
+	var starts []int64
+	last := t.offset() + t.remaining() - 1
+	for start := t.offset(); start <= last; start += segmentSize {
+		starts = append(starts, start)
+	}
+
+	log.Debugf("Downloading %d segments of %s", len(starts), t.r.URL.Path)
+
+	// Segments still running when this function returns are no longer needed, whatever the reason.
+	ctx, cancel := context.WithCancel(t.r.Context())
+	defer cancel()
+
+	results := make([]chan segmentResult, len(starts))
+	next := 0
+	launch := func() {
+		start := starts[next]
+		end := start + segmentSize - 1
+		if end > last {
+			end = last
+		}
+
+		result := make(chan segmentResult, 1)
+		results[next] = result
+		go func() {
+			buf, err := p.fetchSegment(ctx, t, start, end)
+			result <- segmentResult{buf: buf, err: err}
+		}()
+
+		next++
+	}
+
+	parallel := p.ParallelSegments
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	for next < len(starts) && next < parallel {
+		launch()
+	}
+
+	for i := range starts {
+		result := <-results[i]
+		if errors.Is(result.err, errRangeIgnored) {
+			// Reading the whole file to get a segment would download most of it once per segment, so the rest of the
+			// transfer is resumed in a single stream instead.
+			t.rangesIgnored = true
+			return fmt.Errorf("fetching segment at %d, continuing without segments: %w", starts[i], result.err), true
+		}
+
+		if result.err != nil {
+			return fmt.Errorf("fetching segment at %d: %w", starts[i], result.err), true
+		}
+
+		if next < len(starts) {
+			launch()
+		}
+
+		_, err := t.Write(result.buf)
+		if err != nil {
+			return fmt.Errorf("writing segment at %d to client: %w", starts[i], err), false
+		}
+	}
+
+	return nil, false
+}
+
+// fetchSegment downloads the bytes between start and end, both included, retrying on other workers if it fails until
+// the retry budget of the transfer is exhausted, or ctx is done.
+func (p *Pool) fetchSegment(ctx context.Context, t *transfer, start, end int64) ([]byte, error) {
+	for {
+		buf, err := p.trySegment(ctx, t, start, end)
+		if err == nil || errors.Is(err, errRangeIgnored) {
+			return buf, err
+		}
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("segment no longer needed: %w", err)
+		}
+
+		if t.retry() > p.Retries {
+			return nil, fmt.Errorf("max retries exhausted: %w", err)
+		}
+
+		log.Warnf("Retrying segment %d-%d of %s: %v", start, end, t.r.URL.Path, err)
+		p.metrics.Retries.Inc()
+	}
+}
+
+func (p *Pool) trySegment(ctx context.Context, t *transfer, start, end int64) ([]byte, error) {
+	responseChan := make(chan client.Response)
+	request := client.Request{
+		Context:      ctx,
+		Path:         t.r.URL.Path,
+		ResponseChan: responseChan,
+		Header:       t.rangeHeader(start, end),
+	}
+
+	response := p.dispatch(request)
+	if response.Error != nil {
+		return nil, fmt.Errorf("%s%s errored: %w", response.Worker, request.Path, response.Error)
+	}
+	defer response.HTTPResponse.Body.Close()
+
+	done := p.workers.track(response.Worker, request.Path)
+	defer done()
+
+	if response.HTTPResponse.StatusCode == http.StatusOK {
+		response.Done(0, nil)
+		return nil, fmt.Errorf("%s%s: %w", response.Worker, request.Path, errRangeIgnored)
+	}
+
+	_, err := checkRange(response.HTTPResponse, start, t.size)
+	if err != nil {
+		response.Done(0, nil)
+		return nil, fmt.Errorf("%s%s: %w", response.Worker, request.Path, err)
+	}
+
+	body := &countingReader{Reader: response.HTTPResponse.Body}
+	peeked, err := p.peeker.PeekContext(ctx, body)
+	if errors.Is(err, peeker.ErrPeekTimeout) {
+		// The peeker might still be reading from body, so we cannot look into it.
+		p.metrics.PeekTimeouts.Inc()
+		response.Done(0, nil)
+		return nil, fmt.Errorf("%s%s: %w", response.Worker, request.Path, err)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		response.Done(0, nil)
+		return nil, fmt.Errorf("%s%s: segment no longer needed: %w", response.Worker, request.Path, err)
+	}
+
+	reader := io.MultiReader(bytes.NewReader(peeked), body)
+	buf := bytes.NewBuffer(make([]byte, 0, end+1-start))
+	_, err = io.CopyN(buf, reader, end+1-start)
+	if err != nil && body.err == nil {
+		body.err = err
+	}
+
+	response.Done(body.read, body.err)
+	if body.err != nil {
+		return nil, fmt.Errorf("reading %s%s from mirror: %w", response.Worker, request.Path, body.err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package pool
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"roob.re/refractor/cache"
+	"roob.re/refractor/client"
+	"sync"
+	"time"
+)
+
+// stickyTimeout is the maximum time to wait for the worker bound to a sticky mirror to pick up a request, before
+// sending it to any other worker.
+const stickyTimeout = 2 * time.Second
+
+// stickiness keeps track of the mirror each client downloaded repository databases from, so the rest of the databases
+// of the same sync session are downloaded from the same mirror, or from one synced at the same time.
+type stickiness struct {
+	sync.Mutex
+	clients map[string]stickyMirror
+}
+
+type stickyMirror struct {
+	mirror string
+	// update is the time the mirror was last updated, if known. Mirrors updated at the same time are considered
+	// equivalent.
+	update  time.Time
+	expires time.Time
+}
+
+// get returns the mirror client is bound to, if the binding has not expired.
+func (s *stickiness) get(client string) (stickyMirror, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	sm, found := s.clients[client]
+	if !found || time.Now().After(sm.expires) {
+		return stickyMirror{}, false
+	}
+
+	return sm, true
+}
+
+// bind binds client to mirror for window, unless it is already bound to it.
+func (s *stickiness) bind(client string, mirror string, update time.Time, window time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.clients == nil {
+		s.clients = map[string]stickyMirror{}
+	}
+
+	now := time.Now()
+	for key, sm := range s.clients {
+		if now.After(sm.expires) {
+			delete(s.clients, key)
+		}
+	}
+
+	if sm, found := s.clients[client]; found && sm.mirror == mirror {
+		return
+	}
+
+	log.Debugf("Binding repository databases requested by %s to %s for %s", client, mirror, window)
+	s.clients[client] = stickyMirror{
+		mirror:  mirror,
+		update:  update,
+		expires: now.Add(window),
+	}
+}
+
+// sticky returns whether r should be served from the mirror its client is bound to, and the key of the client.
+func (p *Pool) sticky(r *http.Request) (string, bool) {
+	if p.StickyWindow <= 0 || cache.Classify(r.URL.Path) != cache.Revalidate {
+		return "", false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return host, true
+}
+
+// dispatchSticky sends request to a worker bound to the mirror the client is bound to, or to one updated at the same
+// time. If there is none, or they do not pick up the request in time, it is sent to any worker.
+func (p *Pool) dispatchSticky(clientKey string, request client.Request) client.Response {
+	sm, found := p.stickiness.get(clientKey)
+	if !found {
+		return p.dispatch(request)
+	}
+
+	direct := p.workers.direct(func(mirror string) bool {
+		return mirror == sm.mirror
+	})
+	if direct == nil && !sm.update.IsZero() {
+		direct = p.workers.direct(func(mirror string) bool {
+			update, known := p.freshness.lastUpdate(mirror)
+			return known && update.Equal(sm.update)
+		})
+	}
+	if direct == nil {
+		log.Infof("No worker bound to a mirror consistent with %s, sending %s to any worker", sm.mirror, request.Path)
+		return p.dispatch(request)
+	}
+
+	select {
+	case direct <- request:
+	case <-time.After(stickyTimeout):
+		log.Warnf("Worker for %s did not pick up %s in time, sending it to any worker", sm.mirror, request.Path)
+		return p.dispatch(request)
+	case <-request.Context.Done():
+		return client.Response{Error: request.Context.Err()}
+	}
+
+	return awaitResponse(request)
+}
+
+// bindSticky binds the client with the given key to the mirror of the worker that served its request.
+func (p *Pool) bindSticky(clientKey string, workerName string) {
+	mirror, found := p.workers.mirror(workerName)
+	if !found {
+		return
+	}
+
+	update, _ := p.freshness.lastUpdate(mirror)
+	p.stickiness.bind(clientKey, mirror, update, p.StickyWindow)
+}
@@ -0,0 +1,318 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"roob.re/refractor/cache"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// conditionalHeaders are removed from requests resuming a transfer, as the client has already been sent a response for
+// a particular version of the file.
+var conditionalHeaders = []string{"If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// transfer holds the state of a response being written to a client, which can be served by several mirrors in turn if
+// they fail halfway through it.
+type transfer struct {
+	rw http.ResponseWriter
+	r  *http.Request
+
+	// ranged is true if the client requested a single byte range, delimited by start and end.
+	ranged bool
+	// start and end delimit the part of the file being sent to the client. end is -1 if it is the end of the file.
+	start int64
+	end   int64
+	// size is the total size of the file, or -1 if it is not known.
+	size int64
+
+	// headerWritten is true after the status and headers have been sent to the client. After that, the transfer can
+	// only be resumed with the remaining bytes of the same file.
+	headerWritten bool
+	// sent is the number of body bytes written to the client.
+	sent int64
+
+	// fill, if not nil, receives a copy of everything written to the client.
+	fill *cache.Writer
+	// served counts the bytes written to the client.
+	served prometheus.Counter
+
+	// rangesIgnored is true after a mirror answered a segment with the whole file, after which the rest of the transfer
+	// is not segmented.
+	rangesIgnored bool
+
+	// retries counts the failed attempts to serve the transfer, including the ones for its segments, which share the
+	// same budget. It is accessed atomically.
+	retries int32
+}
+
+func newTransfer(rw http.ResponseWriter, r *http.Request, served prometheus.Counter) *transfer {
+	t := &transfer{
+		rw:     rw,
+		r:      r,
+		end:    -1,
+		size:   -1,
+		served: served,
+	}
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		t.start, t.end, t.ranged = parseRange(rangeHeader)
+	}
+
+	return t
+}
+
+// Write sends buf to the client, keeping count of the bytes sent.
+func (t *transfer) Write(buf []byte) (int, error) {
+	n, err := t.rw.Write(buf)
+	t.sent += int64(n)
+	t.served.Add(float64(n))
+	if t.fill != nil {
+		_, _ = t.fill.Write(buf[:n])
+	}
+
+	return n, err
+}
+
+// commit stores the transferred file in the cache, if it was being cached.
+func (t *transfer) commit() {
+	if t.fill == nil {
+		return
+	}
+
+	err := t.fill.Commit()
+	if err != nil {
+		log.Warnf("Could not cache %s: %v", t.r.URL.Path, err)
+	}
+}
+
+// abort discards the partially transferred file from the cache, if it was being cached.
+func (t *transfer) abort() {
+	if t.fill == nil {
+		return
+	}
+
+	t.fill.Abort()
+}
+
+// retry records a failed attempt to serve the transfer, and returns the number of them so far.
+func (t *transfer) retry() int {
+	return int(atomic.AddInt32(&t.retries, 1))
+}
+
+// offset returns the position in the file of the next byte to be sent to the client.
+func (t *transfer) offset() int64 {
+	return t.start + t.sent
+}
+
+// remaining returns how many bytes are left to be sent to the client, or -1 if it is not known.
+func (t *transfer) remaining() int64 {
+	switch {
+	case t.end >= 0:
+		return t.end + 1 - t.offset()
+	case t.size >= 0:
+		return t.size - t.offset()
+	default:
+		return -1
+	}
+}
+
+// resumable returns whether the transfer can be continued by a different mirror once the header has been written.
+func (t *transfer) resumable() bool {
+	return t.size >= 0
+}
+
+// header returns the header to send to the mirror for the next attempt to serve this transfer.
+func (t *transfer) header() http.Header {
+	if !t.headerWritten {
+		return t.r.Header
+	}
+
+	return t.rangeHeader(t.offset(), t.end)
+}
+
+// prepare inspects the response from a mirror and updates the transfer accordingly. It returns the number of bytes that
+// need to be discarded from the response body before writing the rest to the client.
+func (t *transfer) prepare(response *http.Response) (int64, error) {
+	if t.headerWritten {
+		return t.prepareResume(response)
+	}
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, end, size, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if !ok {
+			// Multipart or malformed ranges are passed through as they are, but cannot be resumed.
+			return 0, nil
+		}
+
+		t.start, t.end, t.size = start, end, size
+		return 0, nil
+
+	case http.StatusOK:
+		t.size = response.ContentLength
+		if !t.ranged || t.r.Header.Get("If-Range") != "" || t.size < 0 || t.start >= t.size {
+			t.start, t.end = 0, -1
+			return 0, nil
+		}
+
+		// The mirror ignored the range requested by the client, so we answer with the requested part ourselves.
+		if t.end < 0 || t.end >= t.size {
+			t.end = t.size - 1
+		}
+
+		response.StatusCode = http.StatusPartialContent
+		response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", t.start, t.end, t.size))
+		response.Header.Set("Content-Length", strconv.FormatInt(t.end+1-t.start, 10))
+		return t.start, nil
+
+	default:
+		return 0, nil
+	}
+}
+
+func (t *transfer) prepareResume(response *http.Response) (int64, error) {
+	return checkRange(response, t.offset(), t.size)
+}
+
+// checkRange verifies that response contains the file of the given size starting at offset, either as a range or as a
+// full response. It returns the number of bytes that need to be discarded from the body to get to offset.
+func checkRange(response *http.Response, offset, size int64) (int64, error) {
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, _, rangeSize, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if !ok {
+			return 0, fmt.Errorf("invalid Content-Range %q", response.Header.Get("Content-Range"))
+		}
+
+		if rangeSize != size {
+			return 0, fmt.Errorf("mirror has a file with different size (%d) than the original (%d)", rangeSize, size)
+		}
+
+		if start != offset {
+			return 0, fmt.Errorf("mirror returned range starting at %d, expected %d", start, offset)
+		}
+
+		return 0, nil
+
+	case http.StatusOK:
+		if response.ContentLength != size {
+			return 0, fmt.Errorf("mirror has a file with different size (%d) than the original (%d)", response.ContentLength, size)
+		}
+
+		return offset, nil
+
+	default:
+		return 0, fmt.Errorf("unexpected status %d for range request", response.StatusCode)
+	}
+}
+
+// rangeHeader returns a header to request the bytes between start and end of the file requested by the client.
+// end can be -1 to request the file until the end.
+func (t *transfer) rangeHeader(start, end int64) http.Header {
+	header := t.r.Header.Clone()
+	for _, conditional := range conditionalHeaders {
+		header.Del(conditional)
+	}
+
+	endStr := ""
+	if end >= 0 {
+		endStr = strconv.FormatInt(end, 10)
+	}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%s", start, endStr))
+
+	return header
+}
+
+// parseRange parses the value of a Range header, if it contains a single range. end is -1 for open-ended ranges.
+// Suffix ranges (bytes=-N) and multiple ranges are not supported.
+func parseRange(header string) (start, end int64, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, -1, false
+	}
+
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || startStr == "" {
+		return 0, -1, false
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, false
+	}
+
+	if endStr == "" {
+		return start, -1, true
+	}
+
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, -1, false
+	}
+
+	return start, end, true
+}
+
+// parseContentRange parses the value of a Content-Range header. size is -1 if the server reported it as unknown.
+func parseContentRange(header string) (start, end, size int64, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	if spec == header {
+		return 0, 0, 0, false
+	}
+
+	rangeStr, sizeStr, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	start, end, ok = parseRange("bytes=" + rangeStr)
+	if !ok || end < 0 {
+		return 0, 0, 0, false
+	}
+
+	if sizeStr == "*" {
+		return start, end, -1, true
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	return start, end, size, true
+}
+
+// countingReader keeps count of the bytes read through it, and of the error that interrupted the reads, if any.
+type countingReader struct {
+	io.Reader
+	read int64
+	err  error
+}
+
+func (cr *countingReader) Read(buf []byte) (int, error) {
+	n, err := cr.Reader.Read(buf)
+	cr.read += int64(n)
+	if err != nil && err != io.EOF {
+		cr.err = err
+	}
+
+	return n, err
+}
+
+// countingResponseWriter keeps count of the body bytes written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (crw *countingResponseWriter) Write(buf []byte) (int, error) {
+	n, err := crw.ResponseWriter.Write(buf)
+	crw.written += int64(n)
+
+	return n, err
+}
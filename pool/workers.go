@@ -0,0 +1,293 @@
+package pool
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"roob.re/refractor/client"
+	"roob.re/refractor/stats"
+	"roob.re/refractor/worker"
+	"sync"
+	"time"
+)
+
+// WorkerInfo describes a worker currently active in the pool.
+type WorkerInfo struct {
+	Name   string    `json:"name"`
+	Mirror string    `json:"mirror"`
+	Since  time.Time `json:"since"`
+	// Serving contains the paths being currently transferred from this worker's mirror.
+	Serving []string `json:"serving"`
+}
+
+// registry keeps track of the workers active in the pool, and of what they are serving.
+type registry struct {
+	sync.Mutex
+	workers map[string]*activeWorker
+}
+
+type activeWorker struct {
+	worker  worker.Worker
+	since   time.Time
+	serving map[string]int
+	evict   chan struct{}
+	evicted bool
+	// direct sends requests to this worker in particular.
+	direct chan client.Request
+}
+
+// add registers w as active, if admit returns true for the mirrors the rest of the active workers are bound to.
+func (r *registry) add(w worker.Worker, evict chan struct{}, direct chan client.Request, admit func([]string) bool) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.workers == nil {
+		r.workers = map[string]*activeWorker{}
+	}
+
+	if !admit(r.mirrorsLocked()) {
+		return false
+	}
+
+	r.workers[w.String()] = &activeWorker{
+		worker:  w,
+		since:   time.Now(),
+		serving: map[string]int{},
+		evict:   evict,
+		direct:  direct,
+	}
+
+	return true
+}
+
+// mirrors returns the mirrors active workers are bound to, once per worker.
+func (r *registry) mirrors() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.mirrorsLocked()
+}
+
+func (r *registry) mirrorsLocked() []string {
+	mirrors := make([]string, 0, len(r.workers))
+	for _, aw := range r.workers {
+		if aw.evicted {
+			continue
+		}
+
+		mirrors = append(mirrors, aw.worker.Client.String())
+	}
+
+	return mirrors
+}
+
+func (r *registry) remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.workers, name)
+}
+
+// track records that name is serving path, until the returned function is called.
+func (r *registry) track(name, path string) func() {
+	r.Lock()
+	defer r.Unlock()
+
+	aw, found := r.workers[name]
+	if !found {
+		return func() {}
+	}
+
+	aw.serving[path]++
+
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+
+		aw.serving[path]--
+		if aw.serving[path] <= 0 {
+			delete(aw.serving, path)
+		}
+	}
+}
+
+// evict signals the worker with the given name to leave the pool.
+func (r *registry) evict(name string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	aw, found := r.workers[name]
+	if !found {
+		return fmt.Errorf("worker %q not found", name)
+	}
+
+	if !aw.evicted {
+		close(aw.evict)
+		aw.evicted = true
+	}
+
+	return nil
+}
+
+// evictMirror signals all workers bound to mirror to leave the pool.
+func (r *registry) evictMirror(mirror string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, aw := range r.workers {
+		if aw.worker.Client.String() != mirror || aw.evicted {
+			continue
+		}
+
+		close(aw.evict)
+		aw.evicted = true
+	}
+}
+
+// url returns the URL for path in the mirror of the worker with the given name, if it is active and not evicted.
+func (r *registry) url(name, path string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	aw, found := r.workers[name]
+	if !found || aw.evicted {
+		return "", false
+	}
+
+	return aw.worker.Client.URL(path), true
+}
+
+// mirror returns the mirror the worker with the given name is bound to.
+func (r *registry) mirror(name string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	aw, found := r.workers[name]
+	if !found {
+		return "", false
+	}
+
+	return aw.worker.Client.String(), true
+}
+
+// direct returns the channel to send requests to a worker whose mirror matches, or nil if there is none.
+func (r *registry) direct(matches func(mirror string) bool) chan client.Request {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, aw := range r.workers {
+		if !aw.evicted && aw.direct != nil && matches(aw.worker.Client.String()) {
+			return aw.direct
+		}
+	}
+
+	return nil
+}
+
+// directs returns the channels to send requests to up to n different workers, preferring the ones that are not serving
+// anything.
+func (r *registry) directs(n int) []chan client.Request {
+	r.Lock()
+	defer r.Unlock()
+
+	var idle, busy []chan client.Request
+	for _, aw := range r.workers {
+		if aw.evicted || aw.direct == nil {
+			continue
+		}
+
+		if len(aw.serving) == 0 {
+			idle = append(idle, aw.direct)
+		} else {
+			busy = append(busy, aw.direct)
+		}
+	}
+
+	directs := append(idle, busy...)
+	if len(directs) > n {
+		directs = directs[:n]
+	}
+
+	return directs
+}
+
+func (r *registry) list() []WorkerInfo {
+	r.Lock()
+	defer r.Unlock()
+
+	infos := make([]WorkerInfo, 0, len(r.workers))
+	for name, aw := range r.workers {
+		info := WorkerInfo{
+			Name:    name,
+			Mirror:  aw.worker.Client.String(),
+			Since:   aw.since,
+			Serving: make([]string, 0, len(aw.serving)),
+		}
+
+		for path := range aw.serving {
+			info.Serving = append(info.Serving, path)
+		}
+		slices.Sort(info.Serving)
+
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b WorkerInfo) bool {
+		return a.Since.Before(b.Since)
+	})
+
+	return infos
+}
+
+// ActiveWorkers returns information about the workers currently active in the pool.
+func (p *Pool) ActiveWorkers() []WorkerInfo {
+	return p.workers.list()
+}
+
+// Evict makes the worker with the given name leave the pool before serving any other request.
+func (p *Pool) Evict(name string) error {
+	return p.workers.evict(name)
+}
+
+// Ban prevents mirror from being added to the pool, evicting workers bound to it if there are any.
+func (p *Pool) Ban(mirror string) {
+	p.bans.Lock()
+	p.bans.mirrors[mirror] = true
+	p.bans.Unlock()
+
+	p.workers.evictMirror(mirror)
+}
+
+// Unban allows a previously banned mirror to be added to the pool again.
+func (p *Pool) Unban(mirror string) {
+	p.bans.Lock()
+	defer p.bans.Unlock()
+
+	delete(p.bans.mirrors, mirror)
+}
+
+// Banned returns whether mirror is banned.
+func (p *Pool) Banned(mirror string) bool {
+	p.bans.Lock()
+	defer p.bans.Unlock()
+
+	return p.bans.mirrors[mirror]
+}
+
+// Bans returns the list of banned mirrors.
+func (p *Pool) Bans() []string {
+	p.bans.Lock()
+	defer p.bans.Unlock()
+
+	bans := make([]string, 0, len(p.bans.mirrors))
+	for mirror := range p.bans.mirrors {
+		bans = append(bans, mirror)
+	}
+	slices.Sort(bans)
+
+	return bans
+}
+
+// Stats returns the stats.Stats instance used by the pool to rank workers.
+func (p *Pool) Stats() *stats.Stats {
+	return p.stats
+}
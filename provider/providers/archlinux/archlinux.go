@@ -1,29 +1,53 @@
 package archlinux
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"math/rand"
 	"net/http"
 	"roob.re/refractor/provider/types"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const mirrorsUrl = "https://archlinux.org/mirrors/status/json/"
+const (
+	mirrorsUrl = "https://archlinux.org/mirrors/status/json/"
+	// lastUpdateFile is served by Arch Linux mirrors at their root, and contains the time their contents last changed.
+	lastUpdateFile = "lastupdate"
+)
 
 type config struct {
+	// CountriesList contains the country codes mirrors must be in. Codes prefixed with "!" exclude mirrors in that
+	// country instead. If only exclusions are given, mirrors in any other country are allowed.
 	CountriesList []string `yaml:"countries"`
 	MaxScore      float64  `yaml:"maxScore"`
+	// MinCompletion is the minimum fraction, between 0 and 1, of recent checks in which the mirror was found synced.
+	MinCompletion float64 `yaml:"minCompletion"`
+	// MaxDelay is the maximum time a mirror can lag behind the tier 0 mirror. Mirrors with an unknown delay are
+	// discarded if set.
+	MaxDelay time.Duration `yaml:"maxDelay"`
+	// IPv4 and IPv6 require mirrors to be reachable over each IP version.
+	IPv4      bool `yaml:"ipv4"`
+	IPv6      bool `yaml:"ipv6"`
+	HTTPSOnly bool `yaml:"httpsOnly"`
+	// IncludeInactive keeps mirrors that Arch Linux has marked as inactive.
+	IncludeInactive bool `yaml:"includeInactive"`
 
-	countries map[string]bool
+	countries         map[string]bool
+	excludedCountries map[string]bool
 }
 
 type Provider struct {
 	config
 
+	// mirrorlist caches the filtered mirrorlist. Its mutex is held while it is fetched, so only one fetch runs at a time.
 	mirrorlist struct {
+		sync.Mutex
 		list    []mirror
 		fetched time.Time
 	}
@@ -35,9 +59,23 @@ func New(conf interface{}) (types.Provider, error) {
 		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
 	}
 
-	// Convert country list (human friendly) into map (code friendly)
+	if acConfig.MinCompletion < 0 || acConfig.MinCompletion > 1 {
+		return nil, fmt.Errorf("minCompletion must be between 0 and 1, got %v", acConfig.MinCompletion)
+	}
+
+	// Convert country list (human friendly) into maps (code friendly)
 	acConfig.countries = map[string]bool{}
+	acConfig.excludedCountries = map[string]bool{}
 	for _, country := range acConfig.CountriesList {
+		if excluded := strings.TrimPrefix(country, "!"); excluded != country {
+			if excluded == "" {
+				return nil, fmt.Errorf("invalid country %q", country)
+			}
+
+			acConfig.excludedCountries[excluded] = true
+			continue
+		}
+
 		acConfig.countries[country] = true
 	}
 
@@ -51,47 +89,121 @@ func DefaultConfig() interface{} {
 }
 
 type mirror struct {
-	Score    float64 `json:"score"`
-	Country  string  `json:"country_code"`
-	Protocol string  `json:"protocol"`
-	URL      string  `json:"url"`
+	Score      float64    `json:"score"`
+	Country    string     `json:"country_code"`
+	Protocol   string     `json:"protocol"`
+	URL        string     `json:"url"`
+	LastSync   *time.Time `json:"last_sync"`
+	Completion float64    `json:"completion_pct"`
+	// Delay is the average number of seconds the mirror lags behind, or nil if it has never been found synced.
+	Delay          *int64   `json:"delay"`
+	DurationStddev *float64 `json:"duration_stddev"`
+	Active         bool     `json:"active"`
+	IPv4           bool     `json:"ipv4"`
+	IPv6           bool     `json:"ipv6"`
+	ISOs           bool     `json:"isos"`
 }
 
-func (m *mirror) String() string {
-	return fmt.Sprintf("score=%.2f country=%s url=%s", m.Score, m.Country, m.URL)
+func (m *mirror) metadata() types.Mirror {
+	meta := types.Mirror{
+		URL:      m.URL,
+		Country:  m.Country,
+		Score:    m.Score,
+		Protocol: m.Protocol,
+	}
+
+	if m.LastSync != nil {
+		meta.LastSync = *m.LastSync
+	}
+
+	return meta
 }
 
 func (a *Provider) filter(all []mirror) []mirror {
 	list := make([]mirror, 0, len(all)/4)
 	for _, mirror := range all {
-		if !strings.Contains(mirror.Protocol, "http") {
+		if reason := a.reject(mirror); reason != "" {
+			log.Debugf("Discarding mirror %s: %s", mirror.URL, reason)
 			continue
 		}
 
-		if a.MaxScore > 0 && mirror.Score > a.MaxScore {
-			continue
+		list = append(list, mirror)
+	}
+
+	log.Infof("%d out of %d mirrors match the filters", len(list), len(all))
+	return list
+}
+
+// reject returns why mirror does not match the filters, or an empty string if it does.
+func (a *Provider) reject(mirror mirror) string {
+	if !mirror.Active && !a.IncludeInactive {
+		return "inactive"
+	}
+
+	if !strings.Contains(mirror.Protocol, "http") {
+		return fmt.Sprintf("protocol %s is not supported", mirror.Protocol)
+	}
+
+	if a.HTTPSOnly && mirror.Protocol != "https" {
+		return fmt.Sprintf("protocol %s is not https", mirror.Protocol)
+	}
+
+	if a.MaxScore > 0 && mirror.Score > a.MaxScore {
+		return fmt.Sprintf("score %.2f is above %.2f", mirror.Score, a.MaxScore)
+	}
+
+	if mirror.Completion < a.MinCompletion {
+		return fmt.Sprintf("completion %.2f is below %.2f", mirror.Completion, a.MinCompletion)
+	}
+
+	if a.MaxDelay > 0 {
+		if mirror.Delay == nil {
+			return "delay is unknown"
 		}
 
-		if len(a.countries) > 0 && !a.countries[mirror.Country] {
-			continue
+		if delay := time.Duration(*mirror.Delay) * time.Second; delay > a.MaxDelay {
+			return fmt.Sprintf("delay %s is above %s", delay, a.MaxDelay)
 		}
+	}
 
-		list = append(list, mirror)
+	if a.IPv4 && !mirror.IPv4 {
+		return "not reachable over IPv4"
 	}
 
-	return list
+	if a.IPv6 && !mirror.IPv6 {
+		return "not reachable over IPv6"
+	}
+
+	if a.excludedCountries[mirror.Country] {
+		return fmt.Sprintf("country %q is excluded", mirror.Country)
+	}
+
+	if len(a.countries) > 0 && !a.countries[mirror.Country] {
+		return fmt.Sprintf("country %q is not listed", mirror.Country)
+	}
+
+	return ""
 }
 
-func (a *Provider) mirrors() ([]mirror, error) {
+func (a *Provider) mirrors(ctx context.Context) ([]mirror, error) {
+	a.mirrorlist.Lock()
+	defer a.mirrorlist.Unlock()
+
 	if time.Since(a.mirrorlist.fetched) < time.Hour {
 		return a.mirrorlist.list, nil
 	}
 
 	log.Infof("Requesting mirrorlist from %s", mirrorsUrl)
-	resp, err := http.Get(mirrorsUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirrorsUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetching mirrorlist: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("wrong status code %d", resp.StatusCode)
@@ -116,13 +228,72 @@ func (a *Provider) mirrors() ([]mirror, error) {
 }
 
 func (a *Provider) Mirror() (string, error) {
-	list, err := a.mirrors()
+	mirror, err := a.MirrorContext(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("accessing mirrorlist: %w", err)
+		return "", err
+	}
+
+	return mirror.URL, nil
+}
+
+// MirrorContext returns a random mirror from the filtered mirrorlist, along with its score, country and last sync.
+func (a *Provider) MirrorContext(ctx context.Context) (types.Mirror, error) {
+	list, err := a.mirrors(ctx)
+	if err != nil {
+		return types.Mirror{}, fmt.Errorf("accessing mirrorlist: %w", err)
+	}
+
+	if len(list) == 0 {
+		return types.Mirror{}, fmt.Errorf("no mirror matches the filters")
 	}
 
 	mirror := list[rand.Int63n(int64(len(list)))]
-	log.Infof("Mirror fed to pool: %s", mirror.String())
+	return mirror.metadata(), nil
+}
 
-	return mirror.URL, nil
+// Mirrors returns all the mirrors in the filtered mirrorlist.
+func (a *Provider) Mirrors(ctx context.Context) ([]types.Mirror, error) {
+	list, err := a.mirrors(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("accessing mirrorlist: %w", err)
+	}
+
+	mirrors := make([]types.Mirror, 0, len(list))
+	for _, mirror := range list {
+		mirrors = append(mirrors, mirror.metadata())
+	}
+
+	return mirrors, nil
+}
+
+// LastUpdate returns the time of the last update of mirror, as advertised in its lastupdate file.
+func (a *Provider) LastUpdate(ctx context.Context, mirrorUrl string) (time.Time, error) {
+	url := strings.TrimSuffix(mirrorUrl, "/") + "/" + lastUpdateFile
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fetching %s: %w", lastUpdateFile, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return time.Time{}, fmt.Errorf("wrong status code %d for %s", resp.StatusCode, lastUpdateFile)
+	}
+
+	// lastupdate contains a unix timestamp, and should be tiny.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading %s: %w", lastUpdateFile, err)
+	}
+
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s: %w", lastUpdateFile, err)
+	}
+
+	return time.Unix(timestamp, 0), nil
 }
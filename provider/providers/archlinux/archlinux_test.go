@@ -0,0 +1,166 @@
+package archlinux
+
+import (
+	"encoding/json"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+// statusJson is a trimmed down response of the mirror status API, with a mirror standing out in each of the filters.
+const statusJson = `{
+  "version": 3,
+  "urls": [
+    {"url": "https://es.mirror.example/", "protocol": "https", "country_code": "ES", "score": 1.2,
+     "completion_pct": 1.0, "delay": 600, "active": true, "ipv4": true, "ipv6": true},
+    {"url": "http://es.mirror.example/", "protocol": "http", "country_code": "ES", "score": 1.2,
+     "completion_pct": 1.0, "delay": 600, "active": true, "ipv4": true, "ipv6": true},
+    {"url": "rsync://es.mirror.example/", "protocol": "rsync", "country_code": "ES", "score": 1.2,
+     "completion_pct": 1.0, "delay": 600, "active": true, "ipv4": true, "ipv6": true},
+    {"url": "https://fr.mirror.example/", "protocol": "https", "country_code": "FR", "score": 3.5,
+     "completion_pct": 1.0, "delay": 900, "active": true, "ipv4": true, "ipv6": false},
+    {"url": "https://de.mirror.example/", "protocol": "https", "country_code": "DE", "score": 2.1,
+     "completion_pct": 0.6, "delay": 7200, "active": true, "ipv4": false, "ipv6": true},
+    {"url": "https://it.mirror.example/", "protocol": "https", "country_code": "IT", "score": 8.0,
+     "completion_pct": 0.9, "delay": null, "active": true, "ipv4": true, "ipv6": true},
+    {"url": "https://pt.mirror.example/", "protocol": "https", "country_code": "PT", "score": 1.0,
+     "completion_pct": 1.0, "delay": 300, "active": false, "ipv4": true, "ipv6": true}
+  ]
+}`
+
+func newProvider(t *testing.T, config string) (*Provider, error) {
+	t.Helper()
+
+	conf := DefaultConfig()
+	err := yaml.Unmarshal([]byte(config), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := New(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.(*Provider), nil
+}
+
+func TestProvider_Filters_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	var status struct {
+		Mirrors []mirror `json:"urls"`
+	}
+	err := json.Unmarshal([]byte(statusJson), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:   "Defaults",
+			config: "{}",
+			expected: []string{
+				"https://es.mirror.example/", "http://es.mirror.example/", "https://fr.mirror.example/",
+				"https://de.mirror.example/", "https://it.mirror.example/",
+			},
+		},
+		{
+			name:     "Countries",
+			config:   "countries: [ES, DE]",
+			expected: []string{"https://es.mirror.example/", "http://es.mirror.example/", "https://de.mirror.example/"},
+		},
+		{
+			name:     "Excluded countries",
+			config:   "countries: ['!ES', '!IT']",
+			expected: []string{"https://fr.mirror.example/", "https://de.mirror.example/"},
+		},
+		{
+			name:     "Countries and exclusions",
+			config:   "countries: [ES, FR, '!FR']",
+			expected: []string{"https://es.mirror.example/", "http://es.mirror.example/"},
+		},
+		{
+			name:     "HTTPS only",
+			config:   "httpsOnly: true\ncountries: [ES]",
+			expected: []string{"https://es.mirror.example/"},
+		},
+		{
+			name:     "Max score",
+			config:   "maxScore: 3",
+			expected: []string{"https://es.mirror.example/", "http://es.mirror.example/", "https://de.mirror.example/"},
+		},
+		{
+			name:   "Min completion",
+			config: "minCompletion: 0.9",
+			expected: []string{
+				"https://es.mirror.example/", "http://es.mirror.example/", "https://fr.mirror.example/",
+				"https://it.mirror.example/",
+			},
+		},
+		{
+			name:     "Max delay",
+			config:   "maxDelay: 15m",
+			expected: []string{"https://es.mirror.example/", "http://es.mirror.example/", "https://fr.mirror.example/"},
+		},
+		{
+			name:   "IPv4",
+			config: "ipv4: true",
+			expected: []string{
+				"https://es.mirror.example/", "http://es.mirror.example/", "https://fr.mirror.example/",
+				"https://it.mirror.example/",
+			},
+		},
+		{
+			name:   "IPv6",
+			config: "ipv6: true",
+			expected: []string{
+				"https://es.mirror.example/", "http://es.mirror.example/", "https://de.mirror.example/",
+				"https://it.mirror.example/",
+			},
+		},
+		{
+			name:     "Inactive",
+			config:   "includeInactive: true\ncountries: [PT]",
+			expected: []string{"https://pt.mirror.example/"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			provider, err := newProvider(t, tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filtered := provider.filter(status.Mirrors)
+			if len(filtered) != len(tc.expected) {
+				t.Fatalf("expected mirrors %v, got %v", tc.expected, filtered)
+			}
+
+			for i, m := range filtered {
+				if m.URL != tc.expected[i] {
+					t.Fatalf("expected mirrors %v, got %v", tc.expected, filtered)
+				}
+			}
+		})
+	}
+}
+
+func TestProvider_Rejects_Invalid_Config(t *testing.T) {
+	t.Parallel()
+
+	for _, config := range []string{
+		"countries: ['!']",
+		"minCompletion: 1.5",
+		"minCompletion: -0.1",
+	} {
+		if _, err := newProvider(t, config); err == nil {
+			t.Fatalf("expected an error for config %q", config)
+		}
+	}
+}
@@ -2,12 +2,16 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net/url"
 	"os"
 	"os/exec"
 	"roob.re/refractor/provider/types"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const defaultShell = "/bin/sh"
@@ -18,7 +22,9 @@ type Provider struct {
 
 type config struct {
 	Command string `yaml:"command"`
-	Shell   string `yaml:"shell"`
+	// List, if set, is a command that prints all the mirrors Command might return, one per line.
+	List  string `yaml:"list"`
+	Shell string `yaml:"shell"`
 }
 
 func DefaultConfig() interface{} {
@@ -52,21 +58,117 @@ func New(conf interface{}) (types.Provider, error) {
 }
 
 func (p Provider) Mirror() (string, error) {
-	cmd := exec.Command(p.Shell, "-c", p.Command)
+	mirror, err := p.MirrorContext(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	return mirror.URL, nil
+}
+
+// MirrorContext runs Command, and returns the mirror in the first line of its output. Besides the URL, the line can
+// contain metadata about the mirror as space-separated key=value pairs, where keys are country, score, protocol and
+// lastSync (in RFC 3339 format). Other text is ignored.
+func (p Provider) MirrorContext(ctx context.Context) (types.Mirror, error) {
+	lines, err := p.run(ctx, p.Command)
+	if err != nil {
+		return types.Mirror{}, err
+	}
+
+	if len(lines) > 1 {
+		log.Warnf("Output of %q contains multiple lines, only the first will be used", p.Command)
+	}
+
+	return parse(lines[0])
+}
+
+// Mirrors runs List, and returns the mirrors in its output, which must have the same format as the one of Command.
+func (p Provider) Mirrors(ctx context.Context) ([]types.Mirror, error) {
+	if p.List == "" {
+		return nil, fmt.Errorf("no list command configured")
+	}
+
+	lines, err := p.run(ctx, p.List)
+	if err != nil {
+		return nil, err
+	}
 
-	stderr := log.NewEntry(log.StandardLogger()).WithField("command", p.Command).Writer()
+	mirrors := make([]types.Mirror, 0, len(lines))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		mirror, err := parse(line)
+		if err != nil {
+			return nil, err
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	return mirrors, nil
+}
+
+// run runs command in the configured shell, and returns the trimmed lines of its output.
+func (p Provider) run(ctx context.Context, command string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, p.Shell, "-c", command)
+
+	stderr := log.NewEntry(log.StandardLogger()).WithField("command", command).Writer()
 	defer stderr.Close()
 
 	cmd.Stderr = stderr
 	out, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("running %q: %w", p.Command, err)
+		return nil, fmt.Errorf("running %q: %w", command, err)
 	}
 
-	outLines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if len(outLines) > 1 {
-		log.Warnf("Output of %q contains multiple lines, only the first will be used", p.Command)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	return lines, nil
+}
+
+// parse parses a line of output containing a mirror URL, optionally followed by metadata.
+func parse(line string) (types.Mirror, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return types.Mirror{}, fmt.Errorf("command did not return a mirror")
+	}
+
+	mirror := types.Mirror{URL: fields[0]}
+	if u, err := url.Parse(mirror.URL); err == nil {
+		mirror.Protocol = u.Scheme
+	}
+
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			// Commands written before metadata was supported might print free text after the URL.
+			log.Debugf("Ignoring %q after %s, which is not a key=value pair", field, mirror.URL)
+			continue
+		}
+
+		var err error
+		switch key {
+		case "country":
+			mirror.Country = value
+		case "score":
+			mirror.Score, err = strconv.ParseFloat(value, 64)
+		case "protocol":
+			mirror.Protocol = value
+		case "lastSync":
+			mirror.LastSync, err = time.Parse(time.RFC3339, value)
+		default:
+			log.Debugf("Ignoring unknown metadata %q for %s", key, mirror.URL)
+		}
+
+		if err != nil {
+			return types.Mirror{}, fmt.Errorf("parsing %s of %s: %w", key, mirror.URL, err)
+		}
 	}
 
-	return strings.TrimSpace(outLines[0]), nil
+	return mirror, nil
 }
@@ -0,0 +1,75 @@
+package command_test
+
+import (
+	"context"
+	"gopkg.in/yaml.v3"
+	"roob.re/refractor/provider/providers/command"
+	"roob.re/refractor/provider/types"
+	"testing"
+	"time"
+)
+
+func TestProvider_Parses_Output(t *testing.T) {
+	t.Parallel()
+
+	lastSync := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name     string
+		output   string
+		expected types.Mirror
+	}{
+		{
+			name:     "URL",
+			output:   "https://mirror.example/",
+			expected: types.Mirror{URL: "https://mirror.example/", Protocol: "https"},
+		},
+		{
+			name:   "Metadata",
+			output: "http://mirror.example/ country=ES score=1.5 lastSync=2022-06-01T12:00:00Z",
+			expected: types.Mirror{
+				URL:      "http://mirror.example/",
+				Protocol: "http",
+				Country:  "ES",
+				Score:    1.5,
+				LastSync: lastSync,
+			},
+		},
+		{
+			name:     "Free text",
+			output:   "https://mirror.example/ fastest mirror in 3 runs",
+			expected: types.Mirror{URL: "https://mirror.example/", Protocol: "https"},
+		},
+		{
+			name:     "Free text and metadata",
+			output:   "https://mirror.example/ picked by script country=DE (cached)",
+			expected: types.Mirror{URL: "https://mirror.example/", Protocol: "https", Country: "DE"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			conf := command.DefaultConfig()
+			raw, _ := yaml.Marshal(map[string]string{"command": "echo '" + tc.output + "'", "shell": "/bin/sh"})
+			err := yaml.Unmarshal(raw, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			provider, err := command.New(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mirror, err := provider.(types.MetadataProvider).MirrorContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mirror != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, mirror)
+			}
+		})
+	}
+}
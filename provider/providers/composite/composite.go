@@ -0,0 +1,328 @@
+// Package composite implements a provider that combines mirrors from several other providers, which are arranged in
+// priority tiers and weighted within each tier.
+package composite
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+	"math/rand"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetryAfter = time.Minute
+
+type config struct {
+	Sources []sourceConfig `yaml:"sources"`
+	// RetryAfter is the time a source is skipped for after it returns an error.
+	RetryAfter time.Duration `yaml:"retryAfter"`
+}
+
+type sourceConfig struct {
+	// Name identifies the source in logs. It defaults to the name of its provider.
+	Name string `yaml:"name"`
+	// Tier is the priority of the source. Sources in a tier are only used if all the sources in lower tiers fail.
+	Tier int `yaml:"tier"`
+	// Weight makes the source be used proportionally more often than the rest in its tier. It defaults to 1.
+	Weight int `yaml:"weight"`
+	// Provider contains the name of the provider of this source, and its config, like the top-level provider.
+	Provider map[string]yaml.Node `yaml:"provider"`
+}
+
+type source struct {
+	name     string
+	weight   int
+	provider types.Provider
+	// failedUntil is the time until which the source is skipped after it returned an error.
+	failedUntil time.Time
+}
+
+type Provider struct {
+	retryAfter time.Duration
+	// tiers contains the sources, grouped by tier from the highest to the lowest priority.
+	tiers [][]*source
+
+	mutex sync.Mutex
+	// origins contains the source that returned each mirror.
+	origins map[string]*source
+}
+
+// Builder returns a types.Builder for composite providers, whose sources can use any of the given providers.
+func Builder(builders map[string]types.Builder) types.Builder {
+	return types.Builder{
+		DefaultConfig: func() interface{} {
+			return &config{
+				RetryAfter: defaultRetryAfter,
+			}
+		},
+		New: func(conf interface{}) (types.Provider, error) {
+			return newProvider(conf, builders)
+		},
+	}
+}
+
+func newProvider(conf interface{}, builders map[string]types.Builder) (types.Provider, error) {
+	compositeConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	if len(compositeConfig.Sources) == 0 {
+		return nil, fmt.Errorf("no sources supplied")
+	}
+
+	byTier := map[int][]*source{}
+	for i, sc := range compositeConfig.Sources {
+		src, err := build(sc, builders)
+		if err != nil {
+			return nil, fmt.Errorf("building source #%d: %w", i+1, err)
+		}
+
+		log.Infof("Using source %q with weight %d in tier %d", src.name, src.weight, sc.Tier)
+		byTier[sc.Tier] = append(byTier[sc.Tier], src)
+	}
+
+	tierNumbers := make([]int, 0, len(byTier))
+	for tier := range byTier {
+		tierNumbers = append(tierNumbers, tier)
+	}
+	slices.Sort(tierNumbers)
+
+	p := &Provider{
+		retryAfter: compositeConfig.RetryAfter,
+		origins:    map[string]*source{},
+	}
+	for _, tier := range tierNumbers {
+		p.tiers = append(p.tiers, byTier[tier])
+	}
+
+	return p, nil
+}
+
+// build creates the provider of a source, in the same way server.Server creates the top-level provider.
+func build(sc sourceConfig, builders map[string]types.Builder) (*source, error) {
+	if len(sc.Provider) != 1 {
+		return nil, fmt.Errorf("exactly one provider must be specified, found %d", len(sc.Provider))
+	}
+
+	if sc.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %d", sc.Weight)
+	}
+
+	src := &source{
+		name:   sc.Name,
+		weight: sc.Weight,
+	}
+	if src.weight == 0 {
+		src.weight = 1
+	}
+
+	for pName, yamlConfig := range sc.Provider {
+		pBuilder, found := builders[pName]
+		if !found {
+			return nil, fmt.Errorf("unknown provider %q", pName)
+		}
+
+		pConfig := pBuilder.DefaultConfig()
+		err := yamlConfig.Decode(pConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshalling config for provider %q: %w", pName, err)
+		}
+
+		src.provider, err = pBuilder.New(pConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating provider %q: %w", pName, err)
+		}
+
+		if src.name == "" {
+			src.name = pName
+		}
+	}
+
+	return src, nil
+}
+
+func (p *Provider) Mirror() (string, error) {
+	mirror, err := p.MirrorContext(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	return mirror.URL, nil
+}
+
+// MirrorContext returns a mirror from a source picked at random among the ones in the highest priority tier, according
+// to their weights. If it fails, the rest of the sources in the tier are tried, and then the ones in the next tiers.
+func (p *Provider) MirrorContext(ctx context.Context) (types.Mirror, error) {
+	var errs []string
+	for _, tier := range p.tiers {
+		candidates := p.available(tier)
+		for len(candidates) > 0 {
+			i := pick(candidates)
+			src := candidates[i]
+
+			mirror, err := types.Next(ctx, src.provider)
+			if err == nil {
+				p.remember(mirror.URL, src)
+				return mirror, nil
+			}
+
+			if ctx.Err() != nil {
+				return types.Mirror{}, ctx.Err()
+			}
+
+			log.Warnf("Source %q failed, skipping it for %s: %v", src.name, p.retryAfter, err)
+			p.fail(src)
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			candidates = append(candidates[:i:i], candidates[i+1:]...)
+		}
+	}
+
+	if len(errs) == 0 {
+		return types.Mirror{}, fmt.Errorf("all sources failed in the last %s", p.retryAfter)
+	}
+
+	return types.Mirror{}, fmt.Errorf("all sources failed: %s", strings.Join(errs, "; "))
+}
+
+// Mirrors returns the mirrors of all the sources that can list them.
+func (p *Provider) Mirrors(ctx context.Context) ([]types.Mirror, error) {
+	var mirrors []types.Mirror
+	seen := map[string]bool{}
+	listed := false
+
+	for _, tier := range p.tiers {
+		for _, src := range tier {
+			mp, ok := src.provider.(types.MetadataProvider)
+			if !ok {
+				continue
+			}
+
+			list, err := mp.Mirrors(ctx)
+			if err != nil {
+				log.Warnf("Cannot list mirrors of source %q: %v", src.name, err)
+				continue
+			}
+			listed = true
+
+			for _, mirror := range list {
+				if seen[mirror.URL] {
+					continue
+				}
+				seen[mirror.URL] = true
+
+				mirrors = append(mirrors, mirror)
+			}
+		}
+	}
+
+	if !listed {
+		return nil, fmt.Errorf("no source could list its mirrors")
+	}
+
+	return mirrors, nil
+}
+
+// LastUpdate asks the source that returned mirror when it was last updated. Mirrors not returned by this provider,
+// such as the ones restored from history, are checked by the first source that can.
+func (p *Provider) LastUpdate(ctx context.Context, mirror string) (time.Time, error) {
+	if origin := p.origin(mirror); origin != nil {
+		if checker, ok := origin.(types.FreshnessChecker); ok {
+			return checker.LastUpdate(ctx, mirror)
+		}
+
+		return time.Time{}, types.ErrUnknownFreshness
+	}
+
+	for _, tier := range p.tiers {
+		for _, src := range tier {
+			if checker, ok := src.provider.(types.FreshnessChecker); ok {
+				return checker.LastUpdate(ctx, mirror)
+			}
+		}
+	}
+
+	return time.Time{}, types.ErrUnknownFreshness
+}
+
+// Evicted forwards the eviction of mirror to the source that returned it.
+func (p *Provider) Evicted(mirror string, reason string) {
+	if receiver, ok := p.origin(mirror).(types.FeedbackReceiver); ok {
+		receiver.Evicted(mirror, reason)
+	}
+}
+
+// Sampled forwards the sample of mirror to the source that returned it.
+func (p *Provider) Sampled(mirror string, sample types.Sample) {
+	if receiver, ok := p.origin(mirror).(types.FeedbackReceiver); ok {
+		receiver.Sampled(mirror, sample)
+	}
+}
+
+// available returns the sources in tier that have not failed recently.
+func (p *Provider) available(tier []*source) []*source {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	sources := make([]*source, 0, len(tier))
+	for _, src := range tier {
+		if now.Before(src.failedUntil) {
+			continue
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources
+}
+
+func (p *Provider) fail(src *source) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	src.failedUntil = time.Now().Add(p.retryAfter)
+}
+
+func (p *Provider) remember(mirror string, src *source) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.origins[mirror] = src
+}
+
+// origin returns the provider of the source that returned mirror, or nil if it is not known.
+func (p *Provider) origin(mirror string) types.Provider {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	src, found := p.origins[mirror]
+	if !found {
+		return nil
+	}
+
+	return src.provider
+}
+
+// pick returns the index of a source chosen at random, according to their weights.
+func pick(sources []*source) int {
+	total := 0
+	for _, src := range sources {
+		total += src.weight
+	}
+
+	n := rand.Intn(total)
+	for i, src := range sources {
+		n -= src.weight
+		if n < 0 {
+			return i
+		}
+	}
+
+	return len(sources) - 1
+}
@@ -0,0 +1,86 @@
+package composite_test
+
+import (
+	"gopkg.in/yaml.v3"
+	"roob.re/refractor/provider/providers"
+	"roob.re/refractor/provider/types"
+	"testing"
+)
+
+func newProvider(t *testing.T, config string) types.Provider {
+	t.Helper()
+
+	builder := providers.Map["composite"]
+	conf := builder.DefaultConfig()
+	err := yaml.Unmarshal([]byte(config), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := builder.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestProvider_Falls_Back_To_Next_Tier(t *testing.T) {
+	t.Parallel()
+
+	provider := newProvider(t, `
+sources:
+  - name: broken
+    provider:
+      command:
+        shell: /bin/sh
+        command: exit 1
+  - tier: 1
+    provider:
+      static:
+        mirrors: [https://fallback.mirror/]
+`)
+
+	for i := 0; i < 3; i++ {
+		mirror, err := provider.Mirror()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mirror != "https://fallback.mirror/" {
+			t.Fatalf("expected fallback mirror, got %s", mirror)
+		}
+	}
+}
+
+func TestProvider_Weights_Sources(t *testing.T) {
+	t.Parallel()
+
+	provider := newProvider(t, `
+sources:
+  - weight: 9
+    provider:
+      static:
+        mirrors: [http://lan.mirror/]
+  - provider:
+      static:
+        mirrors: [https://public.mirror/]
+`)
+
+	const draws = 1000
+	lan := 0
+	for i := 0; i < draws; i++ {
+		mirror, err := provider.Mirror()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mirror == "http://lan.mirror/" {
+			lan++
+		}
+	}
+
+	if lan < draws*8/10 || lan == draws {
+		t.Fatalf("expected around 90%% of mirrors to come from the heavier source, got %d out of %d", lan, draws)
+	}
+}
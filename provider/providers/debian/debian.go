@@ -0,0 +1,444 @@
+// Package debian implements a provider that feeds Debian or Ubuntu mirrors from their official mirror lists.
+package debian
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FormatMasterlist is the format of Debian's Mirrors.masterlist, which contains stanzas describing each mirror.
+	FormatMasterlist = "masterlist"
+	// FormatMirrorsTxt is the format used by mirrors.ubuntu.com, which contains one mirror URL per line.
+	FormatMirrorsTxt = "mirrors.txt"
+
+	debianMirrorsUrl = "https://salsa.debian.org/mirror-team/masterlist/-/raw/master/Mirrors.masterlist"
+	// ubuntuMirrorsUrl contains a {country} placeholder, replaced by each of the configured countries.
+	ubuntuMirrorsUrl = "http://mirrors.ubuntu.com/{country}.txt"
+
+	countryPlaceholder = "{country}"
+)
+
+var errNoMirrors = errors.New("no mirrors left after filtering")
+
+type config struct {
+	// Source is the URL or path of the mirror list. If it contains {country}, one list is fetched for each country,
+	// replacing the placeholder with its code.
+	Source string `yaml:"source"`
+	// Format is the format of the list, either masterlist or mirrors.txt.
+	Format string `yaml:"format"`
+
+	CountriesList []string `yaml:"countries"`
+	Architectures []string `yaml:"architectures"`
+	// Protocols is the list of allowed protocols, http and https by default.
+	Protocols []string `yaml:"protocols"`
+	// Suite is the suite whose Release file is checked to know when a mirror was last updated.
+	Suite string `yaml:"suite"`
+
+	countries map[string]bool
+	protocols map[string]bool
+}
+
+type Provider struct {
+	config
+
+	// mirrorlist caches the filtered mirrorlist. Its mutex is held while it is fetched, so only one fetch runs at a time.
+	mirrorlist struct {
+		sync.Mutex
+		list    []mirror
+		fetched time.Time
+	}
+}
+
+// DefaultDebianConfig returns a config that fetches Debian's Mirrors.masterlist.
+func DefaultDebianConfig() interface{} {
+	return &config{
+		Source: debianMirrorsUrl,
+		Format: FormatMasterlist,
+		Suite:  "stable",
+	}
+}
+
+// DefaultUbuntuConfig returns a config that fetches the per-country mirror lists from mirrors.ubuntu.com.
+func DefaultUbuntuConfig() interface{} {
+	return &config{
+		Source: ubuntuMirrorsUrl,
+		Format: FormatMirrorsTxt,
+		// devel always points to the Ubuntu release under development, which is the one updated most often.
+		Suite: "devel",
+	}
+}
+
+func New(conf interface{}) (types.Provider, error) {
+	debConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	if debConfig.Format != FormatMasterlist && debConfig.Format != FormatMirrorsTxt {
+		return nil, fmt.Errorf("unknown format %q", debConfig.Format)
+	}
+
+	if strings.Contains(debConfig.Source, countryPlaceholder) && len(debConfig.CountriesList) == 0 {
+		// The default list for mirrors.ubuntu.com is geolocated from the client's IP address.
+		debConfig.Source = strings.ReplaceAll(debConfig.Source, countryPlaceholder, "mirrors")
+	}
+
+	if debConfig.Format == FormatMirrorsTxt && len(debConfig.Architectures) > 0 {
+		log.Warnf("Mirror lists in %s format do not contain architectures, architecture filter will be ignored", FormatMirrorsTxt)
+	}
+
+	// Convert country list (human friendly) into map (code friendly)
+	debConfig.countries = map[string]bool{}
+	for _, country := range debConfig.CountriesList {
+		debConfig.countries[strings.ToUpper(country)] = true
+	}
+
+	if len(debConfig.Protocols) == 0 {
+		debConfig.Protocols = []string{"http", "https"}
+	}
+
+	debConfig.protocols = map[string]bool{}
+	for _, protocol := range debConfig.Protocols {
+		debConfig.protocols[strings.ToLower(protocol)] = true
+	}
+
+	return &Provider{
+		config: *debConfig,
+	}, nil
+}
+
+type mirror struct {
+	URL      string
+	Protocol string
+	Country  string
+	// Architectures is the list of architectures carried by the mirror. An empty list means all of them, except those
+	// in ExcludedArchitectures.
+	Architectures         []string
+	ExcludedArchitectures []string
+}
+
+func (m *mirror) String() string {
+	return fmt.Sprintf("country=%s url=%s", m.Country, m.URL)
+}
+
+func (d *Provider) filter(all []mirror) []mirror {
+	list := make([]mirror, 0, len(all)/4)
+	for _, mirror := range all {
+		if !d.protocols[mirror.Protocol] {
+			continue
+		}
+
+		if len(d.countries) > 0 && !d.countries[mirror.Country] {
+			continue
+		}
+
+		if !hasArchitectures(mirror, d.Architectures) {
+			continue
+		}
+
+		list = append(list, mirror)
+	}
+
+	return list
+}
+
+func hasArchitectures(m mirror, required []string) bool {
+	for _, req := range required {
+		if contains(m.ExcludedArchitectures, req) {
+			return false
+		}
+
+		if len(m.Architectures) > 0 && !contains(m.Architectures, req) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(list []string, item string) bool {
+	for _, elem := range list {
+		if elem == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Provider) mirrors() ([]mirror, error) {
+	d.mirrorlist.Lock()
+	defer d.mirrorlist.Unlock()
+
+	if time.Since(d.mirrorlist.fetched) < time.Hour {
+		if len(d.mirrorlist.list) == 0 {
+			return nil, errNoMirrors
+		}
+
+		return d.mirrorlist.list, nil
+	}
+
+	var all []mirror
+	if strings.Contains(d.Source, countryPlaceholder) {
+		for country := range d.countries {
+			countryMirrors, err := d.fetch(strings.ReplaceAll(d.Source, countryPlaceholder, country))
+			if err != nil {
+				return nil, err
+			}
+
+			for i := range countryMirrors {
+				countryMirrors[i].Country = country
+			}
+
+			all = append(all, countryMirrors...)
+		}
+	} else {
+		var err error
+		all, err = d.fetch(d.Source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Empty lists are cached as well, so a list without matching mirrors is not fetched again on every call.
+	list := d.filter(all)
+	d.mirrorlist.list = list
+	d.mirrorlist.fetched = time.Now()
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w out of %d", errNoMirrors, len(all))
+	}
+
+	return list, nil
+}
+
+func (d *Provider) fetch(source string) ([]mirror, error) {
+	log.Infof("Requesting mirrorlist from %s", source)
+
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("fetching mirrorlist: %w", err)
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("wrong status code %d", resp.StatusCode)
+		}
+
+		body = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("opening mirrorlist: %w", err)
+		}
+
+		body = file
+	}
+	defer body.Close()
+
+	switch d.Format {
+	case FormatMasterlist:
+		return parseMasterlist(body)
+	default:
+		return parseMirrorsTxt(body)
+	}
+}
+
+// parseMirrorsTxt parses a list containing one mirror URL per line.
+func parseMirrorsTxt(r io.Reader) ([]mirror, error) {
+	var list []mirror
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		protocol, _, found := strings.Cut(line, "://")
+		if !found {
+			log.Debugf("Ignoring malformed mirror URL %q", line)
+			continue
+		}
+
+		list = append(list, mirror{
+			URL:      line,
+			Protocol: protocol,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading mirrorlist: %w", err)
+	}
+
+	return list, nil
+}
+
+// parseMasterlist parses a list in the format of Debian's Mirrors.masterlist. It contains stanzas separated by empty
+// lines, each of them describing a site with fields such as:
+//
+//	Site: ftp.es.debian.org
+//	Country: ES Spain
+//	Archive-architecture: amd64 arm64 armel armhf i386
+//	Archive-http: /debian/
+func parseMasterlist(r io.Reader) ([]mirror, error) {
+	var list []mirror
+
+	stanza := map[string]string{}
+	lastKey := ""
+	flush := func() {
+		list = append(list, stanzaMirrors(stanza)...)
+		stanza = map[string]string{}
+		lastKey = ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			// Continuation of the previous field.
+			if lastKey != "" {
+				stanza[lastKey] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+
+		lastKey = strings.ToLower(strings.TrimSpace(key))
+		stanza[lastKey] = strings.TrimSpace(value)
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading mirrorlist: %w", err)
+	}
+
+	return list, nil
+}
+
+// stanzaMirrors returns one mirror for each protocol the site described by stanza serves the archive over.
+func stanzaMirrors(stanza map[string]string) []mirror {
+	site := stanza["site"]
+	if site == "" {
+		return nil
+	}
+
+	country, _, _ := strings.Cut(stanza["country"], " ")
+
+	var architectures, excluded []string
+	for _, arch := range strings.Fields(stanza["archive-architecture"]) {
+		switch {
+		case arch == "any":
+		case strings.HasPrefix(arch, "!"):
+			excluded = append(excluded, strings.TrimPrefix(arch, "!"))
+		default:
+			architectures = append(architectures, arch)
+		}
+	}
+
+	var mirrors []mirror
+	for _, protocol := range []string{"http", "https"} {
+		path := stanza["archive-"+protocol]
+		if path == "" {
+			continue
+		}
+
+		mirrors = append(mirrors, mirror{
+			URL:                   protocol + "://" + site + "/" + strings.TrimPrefix(path, "/"),
+			Protocol:              protocol,
+			Country:               strings.ToUpper(country),
+			Architectures:         architectures,
+			ExcludedArchitectures: excluded,
+		})
+	}
+
+	return mirrors
+}
+
+func (d *Provider) Mirror() (string, error) {
+	list, err := d.mirrors()
+	if err != nil {
+		return "", fmt.Errorf("accessing mirrorlist: %w", err)
+	}
+
+	mirror := list[rand.Int63n(int64(len(list)))]
+	log.Infof("Mirror fed to pool: %s", mirror.String())
+
+	return mirror.URL, nil
+}
+
+// LastUpdate returns the time of the last update of mirror, as advertised in the Date field of the Release file of the
+// configured suite.
+func (d *Provider) LastUpdate(ctx context.Context, mirrorUrl string) (time.Time, error) {
+	url := fmt.Sprintf("%s/dists/%s/Release", strings.TrimSuffix(mirrorUrl, "/"), d.Suite)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fetching Release: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return time.Time{}, fmt.Errorf("wrong status code %d for Release", resp.StatusCode)
+	}
+
+	return parseReleaseDate(resp.Body)
+}
+
+// parseReleaseDate returns the Date field of a Release file, which is found among the first lines of it.
+func parseReleaseDate(r io.Reader) (time.Time, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			// The header of the Release file ends where the list of files starts.
+			break
+		}
+
+		if key != "Date" {
+			continue
+		}
+
+		for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+			date, err := time.Parse(layout, strings.TrimSpace(value))
+			if err == nil {
+				return date, nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("cannot parse Date %q", value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("reading Release: %w", err)
+	}
+
+	return time.Time{}, fmt.Errorf("Release does not contain a Date field")
+}
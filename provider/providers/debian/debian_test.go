@@ -0,0 +1,217 @@
+package debian_test
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"roob.re/refractor/provider/providers/debian"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"testing"
+)
+
+const masterlist = `Site: es.mirror.example
+Country: ES Spain
+Archive-architecture: amd64 arm64
+Archive-http: /debian/
+Archive-https: /debian/
+
+Site: fr.mirror.example
+Country: FR France
+Archive-architecture: any !i386
+Archive-http: /debian/
+Archive-upstream: ftp.debian.org
+
+Site: de.mirror.example
+Country: DE Germany
+Archive-architecture: amd64
+ i386
+Archive-https: debian
+
+Country: IT Italy
+Archive-http: /debian/
+`
+
+// mirrors returns the mirrors returned by provider. Mirrors are picked at random, so it is asked enough times to be
+// virtually certain that all of them are returned.
+func mirrors(t *testing.T, provider types.Provider) []string {
+	t.Helper()
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		mirror, err := provider.Mirror()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen[mirror] = true
+	}
+
+	list := make([]string, 0, len(seen))
+	for mirror := range seen {
+		list = append(list, mirror)
+	}
+
+	return list
+}
+
+func newProvider(t *testing.T, defaults func() interface{}, config string) (types.Provider, error) {
+	t.Helper()
+
+	conf := defaults()
+	err := yaml.Unmarshal([]byte(config), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return debian.New(conf)
+}
+
+func assertMirrors(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("expected mirrors %v, got %v", expected, got)
+	}
+
+	for _, mirror := range expected {
+		found := false
+		for _, g := range got {
+			found = found || g == mirror
+		}
+
+		if !found {
+			t.Fatalf("expected mirrors %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestProvider_Filters_Masterlist(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "Mirrors.masterlist")
+	err := os.WriteFile(path, []byte(masterlist), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name: "All",
+			expected: []string{
+				"http://es.mirror.example/debian/",
+				"https://es.mirror.example/debian/",
+				"http://fr.mirror.example/debian/",
+				"https://de.mirror.example/debian",
+			},
+		},
+		{
+			name:   "Country",
+			config: "countries: [es, DE]",
+			expected: []string{
+				"http://es.mirror.example/debian/",
+				"https://es.mirror.example/debian/",
+				"https://de.mirror.example/debian",
+			},
+		},
+		{
+			// FR carries any architecture but i386, and the architectures of DE span two lines.
+			name:     "Architecture",
+			config:   "architectures: [i386]",
+			expected: []string{"https://de.mirror.example/debian"},
+		},
+		{
+			name:   "Excluded_Architecture",
+			config: "architectures: [arm64]",
+			expected: []string{
+				"http://es.mirror.example/debian/",
+				"https://es.mirror.example/debian/",
+				"http://fr.mirror.example/debian/",
+			},
+		},
+		{
+			name:     "Protocol",
+			config:   "protocols: [HTTPS]",
+			expected: []string{"https://es.mirror.example/debian/", "https://de.mirror.example/debian"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := fmt.Sprintf("source: %s\n%s\n", path, tc.config)
+			provider, err := newProvider(t, debian.DefaultDebianConfig, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertMirrors(t, mirrors(t, provider), tc.expected...)
+		})
+	}
+}
+
+func TestProvider_Fetches_Mirrors_Txt_By_Country(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for country, list := range map[string]string{
+		"ES": "# Spain\nhttp://es.mirror.example/ubuntu/\nhttps://es.mirror.example/ubuntu/\nnot a url\n",
+		"FR": "http://fr.mirror.example/ubuntu/\n",
+		"DE": "http://de.mirror.example/ubuntu/\n",
+	} {
+		err := os.WriteFile(filepath.Join(dir, country+".txt"), []byte(list), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := fmt.Sprintf("source: %s\ncountries: [es, FR]\n", filepath.Join(dir, "{country}.txt"))
+	provider, err := newProvider(t, debian.DefaultUbuntuConfig, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMirrors(t, mirrors(t, provider),
+		"http://es.mirror.example/ubuntu/", "https://es.mirror.example/ubuntu/", "http://fr.mirror.example/ubuntu/")
+
+	provider, err = newProvider(t, debian.DefaultUbuntuConfig, config+"protocols: [https]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMirrors(t, mirrors(t, provider), "https://es.mirror.example/ubuntu/")
+}
+
+func TestProvider_Fails_Without_Matching_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "Mirrors.masterlist")
+	err := os.WriteFile(path, []byte(masterlist), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := newProvider(t, debian.DefaultDebianConfig, "source: "+path+"\ncountries: [PT]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.Mirror(); err == nil || !strings.Contains(err.Error(), "no mirrors left") {
+		t.Fatalf("expected an error about no mirrors matching, got %v", err)
+	}
+
+	// The empty result is cached, so the list is not fetched again.
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.Mirror(); err == nil || !strings.Contains(err.Error(), "no mirrors left") {
+		t.Fatalf("expected the empty list to be cached, got %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+// Package exec implements a provider that starts a helper process once, and talks to it over its standard input and
+// output using a line-delimited JSON protocol.
+//
+// Refractor writes one Message per line to the standard input of the helper. Messages of type "mirror" are requests
+// for a mirror, which the helper must answer by writing a Reply with the same ID to its standard output. Messages of
+// type "evicted" and "sample" are feedback about mirrors the helper returned before, and must not be answered:
+//
+//	> {"type":"mirror","id":1}
+//	< {"id":1,"mirror":"https://mirror.example/archlinux/"}
+//	> {"type":"sample","mirror":"https://mirror.example/archlinux/","bytes":1048576,"durationMs":350,"ttfbMs":40}
+//	> {"type":"evicted","mirror":"https://mirror.example/archlinux/","reason":"performance"}
+//
+// The standard error of the helper is logged. The helper should exit when its standard input is closed. If it exits
+// on its own, it is started again the next time a mirror is needed.
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	osexec "os/exec"
+	"roob.re/refractor/provider/types"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShell   = "/bin/sh"
+	defaultTimeout = 10 * time.Second
+	// restartBackoff is the minimum time between starts of the helper.
+	restartBackoff = 5 * time.Second
+	// outboxSize is the number of messages that can be waiting to be written to the helper. Feedback is dropped if
+	// the helper does not keep up.
+	outboxSize = 64
+)
+
+// Types of Message.
+const (
+	MessageMirror  = "mirror"
+	MessageEvicted = "evicted"
+	MessageSample  = "sample"
+)
+
+// Message is a line written by Refractor to the standard input of the helper.
+type Message struct {
+	Type string `json:"type"`
+	// ID identifies mirror requests, and must be copied to their Reply.
+	ID uint64 `json:"id,omitempty"`
+	// Mirror is the mirror feedback messages refer to.
+	Mirror string `json:"mirror,omitempty"`
+	// Reason is one of the metrics.Eviction* reasons, for evicted messages.
+	Reason string `json:"reason,omitempty"`
+	// Bytes, DurationMs and TTFBMs describe the transfer, for sample messages.
+	Bytes      int64 `json:"bytes,omitempty"`
+	DurationMs int64 `json:"durationMs,omitempty"`
+	TTFBMs     int64 `json:"ttfbMs,omitempty"`
+}
+
+// Reply is a line written by the helper to its standard output, in response to a mirror request.
+type Reply struct {
+	ID     uint64 `json:"id"`
+	Mirror string `json:"mirror"`
+	// Error, if not empty, makes the request fail with this error.
+	Error string `json:"error"`
+}
+
+type config struct {
+	Command string `yaml:"command"`
+	Shell   string `yaml:"shell"`
+	// Timeout is the time the helper has to reply to a mirror request.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type Provider struct {
+	config
+
+	// requests serializes mirror requests.
+	requests sync.Mutex
+	lastID   uint64
+
+	// mutex protects helper and started, which are replaced when the helper is restarted.
+	mutex   sync.RWMutex
+	helper  *helper
+	started time.Time
+}
+
+// helper is a running instance of the helper process.
+type helper struct {
+	outbox  chan Message
+	replies chan Reply
+	// exited is closed once the process has exited.
+	exited chan struct{}
+}
+
+func DefaultConfig() interface{} {
+	return &config{
+		Timeout: defaultTimeout,
+	}
+}
+
+func New(conf interface{}) (types.Provider, error) {
+	execConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	if execConfig.Command == "" {
+		return nil, fmt.Errorf("invalid command %q", execConfig.Command)
+	}
+
+	if execConfig.Shell == "" {
+		execConfig.Shell = os.Getenv("SHELL")
+	}
+
+	if execConfig.Shell == "" {
+		execConfig.Shell = defaultShell
+		log.Warnf("Could not figure out shell from the environment ($SHELL), using code default")
+	}
+
+	p := &Provider{
+		config: *execConfig,
+	}
+
+	_, err := p.running()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Provider) Mirror() (string, error) {
+	p.requests.Lock()
+	defer p.requests.Unlock()
+
+	h, err := p.running()
+	if err != nil {
+		return "", err
+	}
+
+	p.lastID++
+	id := p.lastID
+	timeout := time.After(p.Timeout)
+
+	select {
+	case h.outbox <- Message{Type: MessageMirror, ID: id}:
+	case <-h.exited:
+		return "", fmt.Errorf("helper exited")
+	case <-timeout:
+		return "", fmt.Errorf("helper did not read the request within %s", p.Timeout)
+	}
+
+	for {
+		select {
+		case reply := <-h.replies:
+			if reply.ID != id {
+				log.Debugf("Discarding reply to request %d from helper, it already timed out", reply.ID)
+				continue
+			}
+
+			if reply.Error != "" {
+				return "", fmt.Errorf("helper returned an error: %s", reply.Error)
+			}
+
+			if reply.Mirror == "" {
+				return "", fmt.Errorf("helper returned an empty mirror")
+			}
+
+			return reply.Mirror, nil
+		case <-h.exited:
+			return "", fmt.Errorf("helper exited")
+		case <-timeout:
+			return "", fmt.Errorf("helper did not reply within %s", p.Timeout)
+		}
+	}
+}
+
+// Evicted tells the helper that a worker bound to mirror has left the pool.
+func (p *Provider) Evicted(mirror string, reason string) {
+	p.notify(Message{Type: MessageEvicted, Mirror: mirror, Reason: reason})
+}
+
+// Sampled tells the helper that a transfer from mirror has completed.
+func (p *Provider) Sampled(mirror string, sample types.Sample) {
+	p.notify(Message{
+		Type:       MessageSample,
+		Mirror:     mirror,
+		Bytes:      sample.Bytes,
+		DurationMs: sample.Duration.Milliseconds(),
+		TTFBMs:     sample.TTFB.Milliseconds(),
+	})
+}
+
+// notify sends a message to the helper, if it is running and keeping up. It never blocks.
+func (p *Provider) notify(msg Message) {
+	p.mutex.RLock()
+	h := p.helper
+	p.mutex.RUnlock()
+
+	if h == nil {
+		return
+	}
+
+	select {
+	case h.outbox <- msg:
+	default:
+		log.Debugf("Dropping %s message for %s, helper is not keeping up", msg.Type, msg.Mirror)
+	}
+}
+
+// running returns the running helper, starting it if it has exited, unless it was started too recently.
+func (p *Provider) running() (*helper, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.helper != nil {
+		select {
+		case <-p.helper.exited:
+		default:
+			return p.helper, nil
+		}
+	}
+
+	if wait := restartBackoff - time.Since(p.started); !p.started.IsZero() && wait > 0 {
+		return nil, fmt.Errorf("helper exited, restarting it in %s", wait.Round(time.Second))
+	}
+
+	p.started = time.Now()
+	h, err := p.start()
+	if err != nil {
+		return nil, fmt.Errorf("starting helper: %w", err)
+	}
+
+	p.helper = h
+	return h, nil
+}
+
+// start starts the helper process, along with the goroutines that talk to it.
+func (p *Provider) start() (*helper, error) {
+	cmd := osexec.Command(p.Shell, "-c", p.Command)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdin pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout pipe: %w", err)
+	}
+
+	stderr := log.NewEntry(log.StandardLogger()).WithField("command", p.Command).Writer()
+	cmd.Stderr = stderr
+
+	err = cmd.Start()
+	if err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("running %q: %w", p.Command, err)
+	}
+
+	log.Infof("Started helper %q with pid %d", p.Command, cmd.Process.Pid)
+
+	h := &helper{
+		outbox:  make(chan Message, outboxSize),
+		replies: make(chan Reply, outboxSize),
+		exited:  make(chan struct{}),
+	}
+
+	go func() {
+		defer stdin.Close()
+
+		encoder := json.NewEncoder(stdin)
+		for {
+			select {
+			case msg := <-h.outbox:
+				err := encoder.Encode(msg)
+				if err != nil {
+					log.Warnf("Writing to helper: %v", err)
+					return
+				}
+			case <-h.exited:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(h.exited)
+		defer stderr.Close()
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			reply := Reply{}
+			err := json.Unmarshal(scanner.Bytes(), &reply)
+			if err != nil {
+				log.Warnf("Ignoring malformed line from helper %q: %v", scanner.Text(), err)
+				continue
+			}
+
+			select {
+			case h.replies <- reply:
+			default:
+				log.Warnf("Discarding unexpected reply %d from helper", reply.ID)
+			}
+		}
+
+		// Wait must only be called once everything has been read from stdout.
+		err := cmd.Wait()
+		if err != nil {
+			log.Warnf("Helper %q exited: %v", p.Command, err)
+			return
+		}
+
+		log.Warnf("Helper %q exited", p.Command)
+	}()
+
+	return h, nil
+}
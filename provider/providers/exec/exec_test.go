@@ -0,0 +1,100 @@
+package exec_test
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"roob.re/refractor/provider/providers/exec"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helperScript answers mirror requests with a fixed mirror, and appends feedback messages to the file in $FEEDBACK.
+const helperScript = `
+while read -r line; do
+  case "$line" in
+    *'"type":"mirror"'*)
+      id=$(echo "$line" | sed 's/.*"id":\([0-9]*\).*/\1/')
+      echo "{\"id\":$id,\"mirror\":\"https://mirror.example/\"}"
+      ;;
+    *)
+      echo "$line" >> "$FEEDBACK"
+      ;;
+  esac
+done
+`
+
+func newProvider(t *testing.T, feedback string) types.Provider {
+	t.Helper()
+
+	conf := exec.DefaultConfig()
+	err := yaml.Unmarshal([]byte("shell: /bin/sh\ntimeout: 5s"), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := filepath.Join(t.TempDir(), "helper.sh")
+	err = os.WriteFile(script, []byte(helperScript), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := map[string]string{"command": "FEEDBACK=" + feedback + " sh " + script}
+	raw, _ := yaml.Marshal(node)
+	err = yaml.Unmarshal(raw, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := exec.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestProvider_Requests_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	provider := newProvider(t, os.DevNull)
+	for i := 0; i < 3; i++ {
+		mirror, err := provider.Mirror()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mirror != "https://mirror.example/" {
+			t.Fatalf("unexpected mirror %q", mirror)
+		}
+	}
+}
+
+func TestProvider_Reports_Feedback(t *testing.T) {
+	t.Parallel()
+
+	feedback := filepath.Join(t.TempDir(), "feedback")
+	provider := newProvider(t, feedback)
+
+	receiver, ok := provider.(types.FeedbackReceiver)
+	if !ok {
+		t.Fatalf("provider does not receive feedback")
+	}
+
+	receiver.Sampled("https://mirror.example/", types.Sample{Bytes: 1024, Duration: time.Second})
+	receiver.Evicted("https://mirror.example/", "performance")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		contents, _ := os.ReadFile(feedback)
+		if strings.Contains(string(contents), `"type":"sample"`) && strings.Contains(string(contents), `"reason":"performance"`) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("helper did not receive feedback")
+}
@@ -0,0 +1,363 @@
+// Package fedora implements a provider that feeds Fedora or EPEL mirrors from MirrorManager metalinks.
+package fedora
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metalinkUrl  = "https://mirrors.fedoraproject.org/metalink"
+	repomdSuffix = "repodata/repomd.xml"
+
+	verifyTimeout = 10 * time.Second
+	maxAttempts   = 5
+)
+
+// hashes contains the supported hash algorithms, from most to least preferred.
+var hashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{name: "sha512", new: sha512.New},
+	{name: "sha256", new: sha256.New},
+	{name: "sha1", new: sha1.New},
+	{name: "md5", new: md5.New},
+}
+
+type config struct {
+	// Metalink is the URL or path of the metalink document. If empty, it is built from Repo and Arch.
+	Metalink string `yaml:"metalink"`
+	Repo     string `yaml:"repo"`
+	Arch     string `yaml:"arch"`
+
+	CountriesList []string `yaml:"countries"`
+	// MinPreference filters out mirrors with a lower preference in the metalink.
+	MinPreference int `yaml:"minPreference"`
+	// Protocols is the list of allowed protocols, http and https by default.
+	Protocols []string `yaml:"protocols"`
+	// Verify enables checking that the repomd.xml served by each mirror matches the hash in the metalink before
+	// feeding it to the pool.
+	Verify bool `yaml:"verify"`
+
+	countries map[string]bool
+	protocols map[string]bool
+}
+
+type Provider struct {
+	config
+	httpClient *http.Client
+
+	// metalink caches the filtered mirrors and the valid hashes of repomd.xml. Its mutex is held while it is fetched, so
+	// only one fetch runs at a time.
+	metalink struct {
+		sync.Mutex
+		list    []mirror
+		hashes  []map[string]string
+		fetched time.Time
+	}
+}
+
+func DefaultConfig() interface{} {
+	return &config{
+		Arch:   "x86_64",
+		Verify: true,
+	}
+}
+
+func New(conf interface{}) (types.Provider, error) {
+	fConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	if fConfig.Metalink == "" {
+		if fConfig.Repo == "" {
+			return nil, fmt.Errorf("either metalink or repo must be specified")
+		}
+
+		fConfig.Metalink = fmt.Sprintf("%s?repo=%s&arch=%s", metalinkUrl, url.QueryEscape(fConfig.Repo), url.QueryEscape(fConfig.Arch))
+	}
+
+	// Convert country list (human friendly) into map (code friendly)
+	fConfig.countries = map[string]bool{}
+	for _, country := range fConfig.CountriesList {
+		fConfig.countries[strings.ToUpper(country)] = true
+	}
+
+	if len(fConfig.Protocols) == 0 {
+		fConfig.Protocols = []string{"http", "https"}
+	}
+
+	fConfig.protocols = map[string]bool{}
+	for _, protocol := range fConfig.Protocols {
+		fConfig.protocols[strings.ToLower(protocol)] = true
+	}
+
+	return &Provider{
+		config: *fConfig,
+		httpClient: &http.Client{
+			Timeout: verifyTimeout,
+		},
+	}, nil
+}
+
+// metalink is the subset of a MirrorManager metalink document we care about.
+type metalink struct {
+	Files []struct {
+		Name         string       `xml:"name,attr"`
+		Verification verification `xml:"verification"`
+		Alternates   []struct {
+			Verification verification `xml:"verification"`
+		} `xml:"alternates>alternate"`
+		URLs []struct {
+			Protocol   string `xml:"protocol,attr"`
+			Location   string `xml:"location,attr"`
+			Preference int    `xml:"preference,attr"`
+			URL        string `xml:",chardata"`
+		} `xml:"resources>url"`
+	} `xml:"files>file"`
+}
+
+type verification struct {
+	Hashes []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"hash"`
+}
+
+func (v verification) hashes() map[string]string {
+	hashes := map[string]string{}
+	for _, h := range v.Hashes {
+		hashes[strings.ToLower(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+	}
+
+	return hashes
+}
+
+type mirror struct {
+	URL        string
+	Protocol   string
+	Country    string
+	Preference int
+}
+
+func (m *mirror) String() string {
+	return fmt.Sprintf("preference=%d country=%s url=%s", m.Preference, m.Country, m.URL)
+}
+
+func (f *Provider) filter(all []mirror) []mirror {
+	list := make([]mirror, 0, len(all)/4)
+	for _, mirror := range all {
+		if !f.protocols[mirror.Protocol] {
+			continue
+		}
+
+		if mirror.Preference < f.MinPreference {
+			continue
+		}
+
+		if len(f.countries) > 0 && !f.countries[mirror.Country] {
+			continue
+		}
+
+		list = append(list, mirror)
+	}
+
+	return list
+}
+
+func (f *Provider) mirrors() ([]mirror, error) {
+	f.metalink.Lock()
+	defer f.metalink.Unlock()
+
+	if time.Since(f.metalink.fetched) < time.Hour {
+		return f.metalink.list, nil
+	}
+
+	log.Infof("Requesting metalink from %s", f.Metalink)
+
+	var body io.ReadCloser
+	if strings.HasPrefix(f.Metalink, "http://") || strings.HasPrefix(f.Metalink, "https://") {
+		resp, err := http.Get(f.Metalink)
+		if err != nil {
+			return nil, fmt.Errorf("fetching metalink: %w", err)
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("wrong status code %d", resp.StatusCode)
+		}
+
+		body = resp.Body
+	} else {
+		file, err := os.Open(f.Metalink)
+		if err != nil {
+			return nil, fmt.Errorf("opening metalink: %w", err)
+		}
+
+		body = file
+	}
+	defer body.Close()
+
+	var ml metalink
+	err := xml.NewDecoder(body).Decode(&ml)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metalink: %w", err)
+	}
+
+	var all []mirror
+	var validHashes []map[string]string
+	for _, file := range ml.Files {
+		if file.Name != "repomd.xml" {
+			continue
+		}
+
+		validHashes = append(validHashes, file.Verification.hashes())
+		for _, alternate := range file.Alternates {
+			validHashes = append(validHashes, alternate.Verification.hashes())
+		}
+
+		for _, u := range file.URLs {
+			mirrorUrl := strings.TrimSpace(u.URL)
+			if !strings.HasSuffix(mirrorUrl, repomdSuffix) {
+				log.Debugf("Ignoring metalink URL %q not pointing to %s", mirrorUrl, repomdSuffix)
+				continue
+			}
+
+			all = append(all, mirror{
+				URL:        strings.TrimSuffix(mirrorUrl, repomdSuffix),
+				Protocol:   strings.ToLower(u.Protocol),
+				Country:    strings.ToUpper(u.Location),
+				Preference: u.Preference,
+			})
+		}
+	}
+
+	list := f.filter(all)
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no mirrors left after filtering %d", len(all))
+	}
+
+	f.metalink.list = list
+	f.metalink.hashes = validHashes
+	f.metalink.fetched = time.Now()
+
+	return list, nil
+}
+
+// verify checks that the repomd.xml served by m matches one of the hashes listed in the metalink.
+func (f *Provider) verify(m mirror) error {
+	resp, err := f.httpClient.Get(m.URL + repomdSuffix)
+	if err != nil {
+		return fmt.Errorf("fetching repomd.xml: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("wrong status code %d for repomd.xml", resp.StatusCode)
+	}
+
+	repomd, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading repomd.xml: %w", err)
+	}
+
+	// The cached hashes are replaced, never modified, so they can be used after releasing the lock.
+	f.metalink.Lock()
+	validHashes := f.metalink.hashes
+	f.metalink.Unlock()
+
+	for _, valid := range validHashes {
+		for _, algo := range hashes {
+			expected, found := valid[algo.name]
+			if !found {
+				continue
+			}
+
+			h := algo.new()
+			h.Write(repomd)
+			if hex.EncodeToString(h.Sum(nil)) == expected {
+				return nil
+			}
+
+			// Only the strongest hash available is checked.
+			break
+		}
+	}
+
+	return fmt.Errorf("repomd.xml does not match any hash in the metalink")
+}
+
+func (f *Provider) Mirror() (string, error) {
+	list, err := f.mirrors()
+	if err != nil {
+		return "", fmt.Errorf("accessing metalink: %w", err)
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		mirror := list[rand.Int63n(int64(len(list)))]
+		if f.Verify {
+			if err := f.verify(mirror); err != nil {
+				log.Warnf("Rejecting mirror %s: %v", mirror.URL, err)
+				continue
+			}
+		}
+
+		log.Infof("Mirror fed to pool: %s", mirror.String())
+		return mirror.URL, nil
+	}
+
+	return "", fmt.Errorf("could not find a valid mirror after %d attempts", maxAttempts)
+}
+
+// LastUpdate returns the time of the last update of mirror, as advertised in the revision of its repomd.xml.
+func (f *Provider) LastUpdate(ctx context.Context, mirrorUrl string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirrorUrl+repomdSuffix, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fetching repomd.xml: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return time.Time{}, fmt.Errorf("wrong status code %d for repomd.xml", resp.StatusCode)
+	}
+
+	var repomd struct {
+		// Revision is the unix timestamp of the moment the repository metadata was generated.
+		Revision int64 `xml:"revision"`
+	}
+
+	err = xml.NewDecoder(resp.Body).Decode(&repomd)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding repomd.xml: %w", err)
+	}
+
+	if repomd.Revision == 0 {
+		return time.Time{}, fmt.Errorf("repomd.xml does not contain a revision")
+	}
+
+	return time.Unix(repomd.Revision, 0), nil
+}
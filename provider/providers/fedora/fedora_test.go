@@ -0,0 +1,231 @@
+package fedora_test
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roob.re/refractor/provider/providers/fedora"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"testing"
+)
+
+const (
+	currentRepomd  = `<repomd><revision>1700000000</revision></repomd>`
+	previousRepomd = `<repomd><revision>1600000000</revision></repomd>`
+	tamperedRepomd = `<repomd><revision>1700000000</revision><data type="evil"/></repomd>`
+)
+
+func sha256Of(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha512Of(s string) string {
+	sum := sha512.Sum512([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// metalinkURL is a resource of the repomd.xml file in a metalink.
+type metalinkURL struct {
+	protocol   string
+	location   string
+	preference int
+	mirror     string
+}
+
+// writeMetalink writes a metalink listing the given mirrors for repomd.xml, whose current version is currentRepomd and
+// whose previous version is previousRepomd, and returns its path.
+func writeMetalink(t *testing.T, urls ...metalinkURL) string {
+	t.Helper()
+
+	resources := ""
+	for _, u := range urls {
+		resources += fmt.Sprintf(`<url protocol="%s" type="%s" location="%s" preference="%d">%srepodata/repomd.xml</url>
+`, u.protocol, u.protocol, u.location, u.preference, u.mirror)
+	}
+
+	metalink := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/" xmlns:mm0="http://fedorahosted.org/mirrormanager">
+ <files>
+  <file name="repomd.xml">
+   <mm0:alternates>
+    <mm0:alternate>
+     <verification>
+      <hash type="sha256">%s</hash>
+     </verification>
+    </mm0:alternate>
+   </mm0:alternates>
+   <verification>
+    <hash type="sha256">%s</hash>
+    <hash type="sha512">%s</hash>
+   </verification>
+   <resources maxconnections="1">
+%s   </resources>
+  </file>
+ </files>
+</metalink>
+`, sha256Of(previousRepomd), sha256Of(currentRepomd), sha512Of(currentRepomd), resources)
+
+	path := filepath.Join(t.TempDir(), "metalink")
+	err := os.WriteFile(path, []byte(metalink), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func newProvider(t *testing.T, config string) types.Provider {
+	t.Helper()
+
+	conf := fedora.DefaultConfig()
+	err := yaml.Unmarshal([]byte(config), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := fedora.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+// mirrors returns the mirrors returned by provider. Mirrors are picked at random, so it is asked enough times to be
+// virtually certain that all of them are returned.
+func mirrors(t *testing.T, provider types.Provider) map[string]bool {
+	t.Helper()
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		mirror, err := provider.Mirror()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen[mirror] = true
+	}
+
+	return seen
+}
+
+func TestProvider_Filters_Metalink(t *testing.T) {
+	t.Parallel()
+
+	path := writeMetalink(t,
+		metalinkURL{protocol: "https", location: "es", preference: 100, mirror: "https://es.mirror.example/fedora/"},
+		metalinkURL{protocol: "http", location: "es", preference: 90, mirror: "http://es.mirror.example/fedora/"},
+		metalinkURL{protocol: "rsync", location: "es", preference: 90, mirror: "rsync://es.mirror.example/fedora/"},
+		metalinkURL{protocol: "https", location: "fr", preference: 50, mirror: "https://fr.mirror.example/fedora/"},
+	)
+
+	for _, tc := range []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name: "All",
+			expected: []string{
+				"https://es.mirror.example/fedora/",
+				"http://es.mirror.example/fedora/",
+				"https://fr.mirror.example/fedora/",
+			},
+		},
+		{
+			name:     "Country",
+			config:   "countries: [FR]",
+			expected: []string{"https://fr.mirror.example/fedora/"},
+		},
+		{
+			name:     "Protocol",
+			config:   "protocols: [https]",
+			expected: []string{"https://es.mirror.example/fedora/", "https://fr.mirror.example/fedora/"},
+		},
+		{
+			name:     "Preference",
+			config:   "minPreference: 90",
+			expected: []string{"https://es.mirror.example/fedora/", "http://es.mirror.example/fedora/"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			provider := newProvider(t, fmt.Sprintf("metalink: %s\nverify: false\n%s\n", path, tc.config))
+			got := mirrors(t, provider)
+			if len(got) != len(tc.expected) {
+				t.Fatalf("expected mirrors %v, got %v", tc.expected, got)
+			}
+
+			for _, mirror := range tc.expected {
+				if !got[mirror] {
+					t.Fatalf("expected mirrors %v, got %v", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+// repomdMirror serves repomd as the repomd.xml of the repository.
+func repomdMirror(repomd string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/repodata/repomd.xml") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = rw.Write([]byte(repomd))
+	}))
+}
+
+func TestProvider_Verifies_Repomd(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		repomd string
+		valid  bool
+	}{
+		{name: "Current", repomd: currentRepomd, valid: true},
+		// Mirrors that have not synced the latest version yet are still valid.
+		{name: "Alternate", repomd: previousRepomd, valid: true},
+		{name: "Mismatch", repomd: tamperedRepomd, valid: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirror := repomdMirror(tc.repomd)
+			defer mirror.Close()
+
+			url := metalinkURL{protocol: "http", location: "es", preference: 100, mirror: mirror.URL + "/"}
+			path := writeMetalink(t, url)
+			provider := newProvider(t, "metalink: "+path+"\n")
+
+			got, err := provider.Mirror()
+			if !tc.valid {
+				if err == nil {
+					t.Fatalf("expected mirror serving a mismatching repomd.xml to be rejected, got %s", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != mirror.URL+"/" {
+				t.Fatalf("expected %s, got %s", mirror.URL+"/", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Package file implements a provider that feeds mirrors from a pacman mirrorlist, or from a file with one URL per
+// line. The file is reloaded when it changes.
+package file
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"roob.re/refractor/provider/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWatchInterval = 30 * time.Second
+
+type config struct {
+	Path string `yaml:"path"`
+	// Repo and Arch replace the $repo and $arch variables of pacman mirrorlists. If empty, URLs are cut right before
+	// the first variable that cannot be replaced, which yields the root of the mirror.
+	Repo string `yaml:"repo"`
+	Arch string `yaml:"arch"`
+	// WatchInterval is how often the file is checked for changes.
+	WatchInterval time.Duration `yaml:"watchInterval"`
+}
+
+// Mirror is an entry of the file.
+type Mirror struct {
+	URL string
+	// Weight makes the mirror be returned proportionally more often than the rest. It defaults to 1.
+	Weight int
+}
+
+type Provider struct {
+	config
+
+	mutex   sync.Mutex
+	mirrors []Mirror
+	total   int
+	modTime time.Time
+	checked time.Time
+}
+
+func DefaultConfig() interface{} {
+	return &config{
+		WatchInterval: defaultWatchInterval,
+	}
+}
+
+func New(conf interface{}) (types.Provider, error) {
+	fileConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	if fileConfig.Path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	p := &Provider{
+		config: *fileConfig,
+	}
+
+	err := p.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Provider) Mirror() (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.watch()
+
+	n := rand.Intn(p.total)
+	for _, mirror := range p.mirrors {
+		n -= mirror.Weight
+		if n < 0 {
+			return mirror.URL, nil
+		}
+	}
+
+	return "", fmt.Errorf("internal error: weights do not add up")
+}
+
+// watch reloads the file if it has changed since it was last loaded, checking at most once every WatchInterval. If the
+// new contents cannot be loaded, the previous ones are kept. p.mutex must be held.
+func (p *Provider) watch() {
+	if time.Since(p.checked) < p.WatchInterval {
+		return
+	}
+	p.checked = time.Now()
+
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		log.Warnf("Cannot check %s for changes: %v", p.Path, err)
+		return
+	}
+
+	if info.ModTime().Equal(p.modTime) {
+		return
+	}
+
+	err = p.load()
+	if err != nil {
+		log.Warnf("Keeping previous mirrors, cannot reload %s: %v", p.Path, err)
+	}
+}
+
+// load reads the mirrors in the file, replacing the current ones.
+func (p *Provider) load() error {
+	file, err := os.Open(p.Path)
+	if err != nil {
+		return fmt.Errorf("opening mirrorlist: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("reading mirrorlist: %w", err)
+	}
+
+	mirrors, err := Parse(file, p.Repo, p.Arch)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", p.Path, err)
+	}
+
+	if len(mirrors) == 0 {
+		return fmt.Errorf("%s does not contain any mirror", p.Path)
+	}
+
+	total := 0
+	for _, mirror := range mirrors {
+		total += mirror.Weight
+	}
+
+	log.Infof("Loaded %d mirrors from %s", len(mirrors), p.Path)
+	p.mirrors = mirrors
+	p.total = total
+	p.modTime = info.ModTime()
+	p.checked = time.Now()
+
+	return nil
+}
+
+// Parse reads mirrors from a pacman mirrorlist or a file with one URL per line. Empty and commented out lines are
+// ignored. Entries can be given a weight by adding weight=N after the URL, or in a comment at the end of the line so
+// the file remains a valid pacman mirrorlist:
+//
+//	Server = https://mirror.example/archlinux/$repo/os/$arch # weight=3
+//	https://other.example/archlinux/ weight=2
+func Parse(r io.Reader, repo, arch string) ([]Mirror, error) {
+	var mirrors []Mirror
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, comment, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if key, value, found := strings.Cut(text, "="); found && strings.EqualFold(strings.TrimSpace(key), "Server") {
+			text = strings.TrimSpace(value)
+		}
+
+		fields := strings.Fields(text)
+		mirror := Mirror{
+			URL:    expand(fields[0], repo, arch),
+			Weight: 1,
+		}
+
+		for _, field := range append(fields[1:], strings.Fields(comment)...) {
+			if !strings.HasPrefix(field, "weight=") {
+				continue
+			}
+
+			value := strings.TrimPrefix(field, "weight=")
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("line %d: invalid weight %q", line, value)
+			}
+
+			mirror.Weight = weight
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	return mirrors, nil
+}
+
+// expand replaces the $repo and $arch variables of url. If any of them is not supplied, url is cut right before it.
+func expand(url, repo, arch string) string {
+	for _, variable := range []struct {
+		name  string
+		value string
+	}{
+		{name: "$repo", value: repo},
+		{name: "$arch", value: arch},
+	} {
+		if variable.value != "" {
+			url = strings.ReplaceAll(url, variable.name, variable.value)
+			continue
+		}
+
+		if i := strings.Index(url, variable.name); i >= 0 {
+			url = url[:i]
+		}
+	}
+
+	return url
+}
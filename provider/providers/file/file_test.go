@@ -0,0 +1,119 @@
+package file_test
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"roob.re/refractor/provider/providers/file"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mirrorlist = `
+## Spain
+Server = https://es.mirror.example/archlinux/$repo/os/$arch # weight=3
+#Server = https://disabled.mirror.example/archlinux/$repo/os/$arch
+
+https://plain.mirror.example/archlinux/ weight=2
+server=https://lowercase.mirror.example/$repo/os/$arch
+`
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		repo, arch string
+		expected   []file.Mirror
+	}{
+		{
+			name: "Mirror_Root",
+			expected: []file.Mirror{
+				{URL: "https://es.mirror.example/archlinux/", Weight: 3},
+				{URL: "https://plain.mirror.example/archlinux/", Weight: 2},
+				{URL: "https://lowercase.mirror.example/", Weight: 1},
+			},
+		},
+		{
+			name: "Substituted",
+			repo: "core",
+			arch: "x86_64",
+			expected: []file.Mirror{
+				{URL: "https://es.mirror.example/archlinux/core/os/x86_64", Weight: 3},
+				{URL: "https://plain.mirror.example/archlinux/", Weight: 2},
+				{URL: "https://lowercase.mirror.example/core/os/x86_64", Weight: 1},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirrors, err := file.Parse(strings.NewReader(mirrorlist), tc.repo, tc.arch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(mirrors) != len(tc.expected) {
+				t.Fatalf("expected %d mirrors, got %v", len(tc.expected), mirrors)
+			}
+
+			for i := range mirrors {
+				if mirrors[i] != tc.expected[i] {
+					t.Fatalf("expected %v, got %v", tc.expected[i], mirrors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParse_Rejects_Invalid_Weights(t *testing.T) {
+	t.Parallel()
+
+	_, err := file.Parse(strings.NewReader("https://mirror.example/ weight=none\n"), "", "")
+	if err == nil {
+		t.Fatalf("expected invalid weight to be rejected")
+	}
+}
+
+func TestProvider_Reloads_File(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "mirrorlist")
+	err := os.WriteFile(path, []byte("https://old.mirror.example/\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := file.DefaultConfig()
+	err = yaml.Unmarshal([]byte("path: "+path+"\nwatchInterval: 1ms\n"), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := file.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("https://new.mirror.example/\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes even on filesystems with a coarse resolution.
+	err = os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	mirror, err := provider.Mirror()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mirror != "https://new.mirror.example/" {
+		t.Fatalf("expected reloaded mirror, got %s", mirror)
+	}
+}
@@ -3,6 +3,12 @@ package providers
 import (
 	"roob.re/refractor/provider/providers/archlinux"
 	"roob.re/refractor/provider/providers/command"
+	"roob.re/refractor/provider/providers/composite"
+	"roob.re/refractor/provider/providers/debian"
+	"roob.re/refractor/provider/providers/exec"
+	"roob.re/refractor/provider/providers/fedora"
+	"roob.re/refractor/provider/providers/file"
+	"roob.re/refractor/provider/providers/static"
 )
 import "roob.re/refractor/provider/types"
 
@@ -12,8 +18,37 @@ var Map = map[string]types.Builder{
 		DefaultConfig: command.DefaultConfig,
 		New:           command.New,
 	},
+	"exec": {
+		DefaultConfig: exec.DefaultConfig,
+		New:           exec.New,
+	},
+	"static": {
+		DefaultConfig: static.DefaultConfig,
+		New:           static.New,
+	},
+	"file": {
+		DefaultConfig: file.DefaultConfig,
+		New:           file.New,
+	},
 	"archlinux": {
 		DefaultConfig: archlinux.DefaultConfig,
 		New:           archlinux.New,
 	},
+	"debian": {
+		DefaultConfig: debian.DefaultDebianConfig,
+		New:           debian.New,
+	},
+	"ubuntu": {
+		DefaultConfig: debian.DefaultUbuntuConfig,
+		New:           debian.New,
+	},
+	"fedora": {
+		DefaultConfig: fedora.DefaultConfig,
+		New:           fedora.New,
+	},
+}
+
+func init() {
+	// The composite provider builds its sources from Map, so it cannot be part of its initializer.
+	Map["composite"] = composite.Builder(Map)
 }
@@ -0,0 +1,53 @@
+// Package static implements a provider that feeds mirrors from a list in its config.
+package static
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"roob.re/refractor/provider/types"
+	"strings"
+)
+
+type config struct {
+	Mirrors []string `yaml:"mirrors"`
+}
+
+type Provider struct {
+	config
+}
+
+func DefaultConfig() interface{} {
+	return &config{}
+}
+
+func New(conf interface{}) (types.Provider, error) {
+	staticConfig, ok := conf.(*config)
+	if !ok {
+		return nil, fmt.Errorf("internal error: supplied config is not of the expected type")
+	}
+
+	mirrors := make([]string, 0, len(staticConfig.Mirrors))
+	for _, mirror := range staticConfig.Mirrors {
+		mirror = strings.TrimSpace(mirror)
+		if mirror == "" {
+			continue
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("no mirrors supplied")
+	}
+
+	log.Infof("Feeding %d static mirrors", len(mirrors))
+
+	return Provider{
+		config: config{Mirrors: mirrors},
+	}, nil
+}
+
+func (p Provider) Mirror() (string, error) {
+	return p.Mirrors[rand.Intn(len(p.Mirrors))], nil
+}
@@ -1,5 +1,14 @@
 package types
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
 // Provider is an object capable of returning mirror URLs.
 type Provider interface {
 	// Mirror returns the URL for a mirror.
@@ -8,6 +17,83 @@ type Provider interface {
 	Mirror() (string, error)
 }
 
+// Mirror describes a mirror, along with what the provider that returned it knows about it. Only URL is mandatory.
+type Mirror struct {
+	URL string `json:"url"`
+	// Country is the ISO 3166 code of the country the mirror is in.
+	Country string `json:"country,omitempty"`
+	// Score is the score of the mirror as reported by the provider, whose meaning depends on it.
+	Score    float64   `json:"score,omitempty"`
+	Protocol string    `json:"protocol,omitempty"`
+	LastSync time.Time `json:"lastSync,omitempty"`
+}
+
+func (m Mirror) String() string {
+	fields := []string{"url=" + m.URL}
+	if m.Country != "" {
+		fields = append(fields, "country="+m.Country)
+	}
+	if m.Score != 0 {
+		fields = append(fields, fmt.Sprintf("score=%.2f", m.Score))
+	}
+	if m.Protocol != "" {
+		fields = append(fields, "protocol="+m.Protocol)
+	}
+	if !m.LastSync.IsZero() {
+		fields = append(fields, "lastSync="+m.LastSync.UTC().Format(time.RFC3339))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// MetadataProvider can be implemented by providers that know more about their mirrors than their URL, and that can
+// list all of them at once. Its methods should give up when ctx is done.
+type MetadataProvider interface {
+	Provider
+	// MirrorContext is like Provider.Mirror, but returns what the provider knows about the mirror.
+	MirrorContext(ctx context.Context) (Mirror, error)
+	// Mirrors returns all the mirrors the provider might return from Mirror.
+	Mirrors(ctx context.Context) ([]Mirror, error)
+}
+
+// Next returns a mirror from provider, along with its metadata if provider is a MetadataProvider. Otherwise, the
+// protocol is taken from the scheme of the URL. Next returns the error of ctx once it is done, even if provider does not
+// support contexts. In that case, the call to provider is left running in the background.
+func Next(ctx context.Context, provider Provider) (Mirror, error) {
+	if mp, ok := provider.(MetadataProvider); ok {
+		return mp.MirrorContext(ctx)
+	}
+
+	type result struct {
+		url string
+		err error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		mirrorUrl, err := provider.Mirror()
+		results <- result{url: mirrorUrl, err: err}
+	}()
+
+	var mirrorUrl string
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return Mirror{}, res.err
+		}
+		mirrorUrl = res.url
+	case <-ctx.Done():
+		return Mirror{}, ctx.Err()
+	}
+
+	mirror := Mirror{URL: mirrorUrl}
+	if u, err := url.Parse(mirrorUrl); err == nil {
+		mirror.Protocol = u.Scheme
+	}
+
+	return mirror, nil
+}
+
 // Builder contains two functions needed for server.Server to build a provider.
 type Builder struct {
 	// DefaultConfig is expected to return a pointer to an empty struct, which is a provider-specific config.
@@ -18,3 +104,31 @@ type Builder struct {
 	// after the user-supplied config has ben unmarshalled into it.
 	New func(interface{}) (Provider, error)
 }
+
+// FeedbackReceiver can be implemented by providers that want to know how the mirrors they returned perform, for
+// example to keep their own rankings. Its methods are called by pool.Pool as events happen, and must not block.
+type FeedbackReceiver interface {
+	// Evicted is called when a worker bound to mirror leaves the pool, with one of the metrics.Eviction* reasons.
+	Evicted(mirror string, reason string)
+	// Sampled is called when a transfer from mirror completes.
+	Sampled(mirror string, sample Sample)
+}
+
+// Sample describes a transfer from a mirror.
+type Sample struct {
+	Bytes    int64
+	Duration time.Duration
+	// TTFB is the time it took for the first byte of the body to arrive, or zero if none did.
+	TTFB time.Duration
+}
+
+// FreshnessChecker can be implemented by providers that are able to tell when the contents of a mirror were last
+// updated. pool.Pool uses it to reject mirrors that lag behind the most up-to-date ones.
+type FreshnessChecker interface {
+	// LastUpdate returns the time the contents of mirror were last updated, as advertised by the mirror itself.
+	LastUpdate(ctx context.Context, mirror string) (time.Time, error)
+}
+
+// ErrUnknownFreshness can be returned by FreshnessChecker.LastUpdate when it cannot check mirror, but mirror should not
+// be rejected because of it.
+var ErrUnknownFreshness = errors.New("last update of mirror cannot be checked")
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"roob.re/refractor/pool"
+	"roob.re/refractor/provider/types"
+	"strings"
+	"time"
+)
+
+// route is a provider and the pool it feeds, serving requests that match the route's Prefix and Host.
+type route struct {
+	RouteConfig
+	provider types.Provider
+	pool     *pool.Pool
+}
+
+// match returns whether r should be served by this route, and a copy of r with the route prefix removed from its path.
+func (rt *route) match(r *http.Request) (*http.Request, bool) {
+	if rt.Host != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// Host header does not contain a port.
+			host = r.Host
+		}
+
+		if !strings.EqualFold(host, rt.Host) {
+			return nil, false
+		}
+	}
+
+	prefix := strings.TrimSuffix(rt.Prefix, "/")
+	if prefix == "" {
+		return r, true
+	}
+
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		return nil, false
+	}
+
+	routed := r.Clone(r.Context())
+	routed.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	routed.URL.RawPath = ""
+	if routed.URL.Path == "" {
+		routed.URL.Path = "/"
+	}
+
+	return routed, true
+}
+
+// persist saves the history of the mirrors of the route to its state file every StateInterval, until ctx is done.
+func (rt *route) persist(ctx context.Context) {
+	if rt.Stats.StateFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(rt.pool.Stats().StateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rt.saveState()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// saveState saves the history of the mirrors of the route to its state file, if it has one.
+func (rt *route) saveState() {
+	if rt.Stats.StateFile == "" {
+		return
+	}
+
+	err := rt.pool.Stats().SaveState(rt.Stats.StateFile)
+	if err != nil {
+		log.Errorf("Could not save mirror history for route %q: %v", rt.Name, err)
+		return
+	}
+
+	log.Debugf("Saved mirror history for route %q to %s", rt.Name, rt.Stats.StateFile)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute_Matches_Requests(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		prefix  string
+		host    string
+		target  string
+		reqHost string
+		// path is the path of the routed request, or empty if it should not match.
+		path string
+	}{
+		{name: "no prefix", target: "/core/os/x86_64/core.db", path: "/core/os/x86_64/core.db"},
+		{name: "prefix", prefix: "/archlinux", target: "/archlinux/core/core.db", path: "/core/core.db"},
+		{name: "prefix with trailing slash", prefix: "/archlinux/", target: "/archlinux/core.db", path: "/core.db"},
+		{name: "prefix only", prefix: "/archlinux", target: "/archlinux", path: "/"},
+		{name: "prefix only with trailing slash", prefix: "/archlinux", target: "/archlinux/", path: "/"},
+		{name: "prefix of a longer segment", prefix: "/archlinux", target: "/archlinuxfoo/core.db"},
+		{name: "other prefix", prefix: "/archlinux", target: "/debian/dists/stable/Release"},
+		{name: "host", host: "arch.local", target: "/core.db", reqHost: "arch.local", path: "/core.db"},
+		{name: "host with port", host: "arch.local", target: "/core.db", reqHost: "arch.local:8080", path: "/core.db"},
+		{name: "host in other case", host: "arch.local", target: "/core.db", reqHost: "ARCH.local", path: "/core.db"},
+		{name: "other host", host: "arch.local", target: "/core.db", reqHost: "debian.local"},
+		{
+			name: "host and prefix", host: "mirrors.local", prefix: "/arch",
+			target: "/arch/core.db", reqHost: "mirrors.local", path: "/core.db",
+		},
+		{
+			name: "host but not prefix", host: "mirrors.local", prefix: "/arch",
+			target: "/debian/Release", reqHost: "mirrors.local",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rt := &route{RouteConfig: RouteConfig{Prefix: tc.prefix, Host: tc.host}}
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.reqHost != "" {
+				r.Host = tc.reqHost
+			}
+
+			routed, matches := rt.match(r)
+			if matches != (tc.path != "") {
+				t.Fatalf("expected match to be %v", tc.path != "")
+			}
+
+			if matches && routed.URL.Path != tc.path {
+				t.Fatalf("expected routed path %q, got %q", tc.path, routed.URL.Path)
+			}
+
+			if r.URL.Path != tc.target {
+				t.Fatalf("original request was modified, path is now %q", r.URL.Path)
+			}
+		})
+	}
+}
+
+func TestServer_Routes_To_First_Match(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{routes: []*route{
+		{RouteConfig: RouteConfig{Name: "arch-host", Host: "arch.local"}},
+		{RouteConfig: RouteConfig{Name: "arch", Prefix: "/archlinux"}},
+		{RouteConfig: RouteConfig{Name: "arch-testing", Prefix: "/archlinux/testing"}},
+		{RouteConfig: RouteConfig{Name: "fallback"}},
+	}}
+
+	for _, tc := range []struct {
+		target  string
+		reqHost string
+		route   string
+	}{
+		{target: "/archlinux/core.db", reqHost: "arch.local", route: "arch-host"},
+		{target: "/archlinux/core.db", reqHost: "mirrors.local", route: "arch"},
+		// Routes are tried in order, so a more specific prefix after a broader one never matches.
+		{target: "/archlinux/testing/testing.db", reqHost: "mirrors.local", route: "arch"},
+		{target: "/archlinuxfoo/core.db", reqHost: "mirrors.local", route: "fallback"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		r.Host = tc.reqHost
+
+		rt, _ := s.route(r)
+		if rt == nil || rt.Name != tc.route {
+			t.Fatalf("expected %s%s to be served by route %q, got %v", tc.reqHost, tc.target, tc.route, rt)
+		}
+	}
+
+	unmatched := &Server{routes: s.routes[1:3]}
+	if rt, _ := unmatched.route(httptest.NewRequest(http.MethodGet, "/debian/Release", nil)); rt != nil {
+		t.Fatalf("expected no route to match, got %q", rt.Name)
+	}
+}
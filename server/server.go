@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"io"
 	"net/http"
+	"path/filepath"
+	"roob.re/refractor/admin"
+	"roob.re/refractor/cache"
 	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
 	"roob.re/refractor/pool"
 	"roob.re/refractor/provider/providers"
 	"roob.re/refractor/provider/types"
@@ -14,24 +20,63 @@ import (
 	"time"
 )
 
-type Config struct {
+// RouteConfig contains the configuration for a provider, and for the pool of mirrors it feeds.
+type RouteConfig struct {
+	// Name identifies the route in logs, metrics and the admin API.
+	Name string `yaml:"name"`
+	// Prefix, if not empty, routes requests whose path starts with it to this route. The prefix is removed from the
+	// path before requesting it to a mirror.
+	Prefix string `yaml:"prefix"`
+	// Host, if not empty, routes requests whose Host header matches it to this route.
+	Host string `yaml:"host"`
+
 	Pool   pool.Config   `yaml:",inline"`
 	Client client.Config `yaml:",inline"`
 	Stats  stats.Config  `yaml:",inline"`
+	Cache  cache.Config  `yaml:"cache"`
 
 	// Provider contains the name of the chosen provider, and provider-specific config.
 	Provider map[string]yaml.Node
+	// Mirrorlist is the default format of the mirrorlist served by the admin API. It defaults to the format used by
+	// the distro of the provider.
+	Mirrorlist string `yaml:"mirrorlist"`
+}
+
+type Config struct {
+	// Top-level settings define a single route serving all requests. If Routes is not empty, they are used as
+	// defaults for each of the routes instead, except for Cache, StateFile, Provider and Mirrorlist.
+	RouteConfig `yaml:",inline"`
+
+	// Routes allows serving several independent pools, for example for different distros, from one listener.
+	// Requests are served by the first route whose Prefix and Host match.
+	Routes []yaml.Node `yaml:"routes"`
+
+	// ShutdownGracePeriod is the maximum amount of time to wait for active transfers to finish when shutting down.
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod"`
 }
 
 const (
-	defaultPeekSizeMiBs = 1.0
-	defaultPeekTimeout  = 4 * time.Second
-	defaultRetries      = 3
+	defaultRouteName           = "default"
+	defaultPeekSizeMiBs        = 1.0
+	defaultPeekTimeout         = 4 * time.Second
+	defaultRetries             = 3
+	defaultSegmentSizeMiBs     = 8
+	defaultParallelSegments    = 4
+	defaultRedirectSampleRatio = 0.1
+	defaultShutdownGracePeriod = 30 * time.Second
 )
 
+// mirrorlistFormats contains the default mirrorlist format for each provider. Providers not listed default to
+// admin.FormatPlain.
+var mirrorlistFormats = map[string]string{
+	"archlinux": admin.FormatPacman,
+	"debian":    admin.FormatSourcesList,
+	"ubuntu":    admin.FormatSourcesList,
+}
+
 type Server struct {
-	pool     *pool.Pool
-	provider types.Provider
+	routes      []*route
+	gracePeriod time.Duration
 }
 
 func New(configFile io.Reader) (*Server, error) {
@@ -41,8 +86,84 @@ func New(configFile io.Reader) (*Server, error) {
 		return nil, fmt.Errorf("unmarshalling config: %w", err)
 	}
 
+	var routeConfigs []RouteConfig
+	if len(config.Routes) == 0 {
+		if config.Name == "" {
+			config.Name = defaultRouteName
+		}
+
+		routeConfigs = append(routeConfigs, config.RouteConfig)
+	}
+
+	for i, node := range config.Routes {
+		// Routes inherit top-level settings, except for the ones that would not make sense to share.
+		rc := config.RouteConfig
+		rc.Name, rc.Prefix, rc.Host = "", "", ""
+		rc.Cache = cache.Config{}
+		rc.Stats.StateFile = ""
+		rc.Provider = nil
+		rc.Mirrorlist = ""
+
+		err := node.Decode(&rc)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshalling config for route #%d: %w", i, err)
+		}
+
+		if rc.Name == "" {
+			return nil, fmt.Errorf("route #%d does not have a name", i)
+		}
+
+		routeConfigs = append(routeConfigs, rc)
+	}
+
+	// Caches clean up their temporary files when created, so they cannot be shared between routes.
+	cacheDirs := map[string]string{}
+	for _, rc := range routeConfigs {
+		if rc.Cache.Dir == "" {
+			continue
+		}
+
+		dir := filepath.Clean(rc.Cache.Dir)
+		if other, found := cacheDirs[dir]; found {
+			return nil, fmt.Errorf("routes %q and %q use the same cache dir %q", other, rc.Name, dir)
+		}
+		cacheDirs[dir] = rc.Name
+	}
+
+	if config.ShutdownGracePeriod == 0 {
+		log.Infof("Defaulting ShutdownGracePeriod to %s", defaultShutdownGracePeriod)
+		config.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+
+	s := &Server{
+		gracePeriod: config.ShutdownGracePeriod,
+	}
+	names := map[string]bool{}
+	for _, rc := range routeConfigs {
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicated route name %q", rc.Name)
+		}
+		names[rc.Name] = true
+
+		r, err := newRoute(rc)
+		if err != nil {
+			return nil, fmt.Errorf("creating route %q: %w", rc.Name, err)
+		}
+
+		s.routes = append(s.routes, r)
+	}
+
+	return s, nil
+}
+
+func newRoute(config RouteConfig) (*route, error) {
 	// Both pool and stats share the number of workers, as a hack we use pool.Config as the source of truth.
 	config.Stats.NumWorkers = config.Pool.Workers
+	config.Pool.Name = config.Name
+
+	if len(config.Provider) != 1 {
+		return nil, fmt.Errorf("exactly one provider must be specified, found %d", len(config.Provider))
+	}
 
 	var provider types.Provider
 	for pName, yamlConfig := range config.Provider {
@@ -62,9 +183,11 @@ func New(configFile io.Reader) (*Server, error) {
 			return nil, fmt.Errorf("creating provider %q: %w", pName, err)
 		}
 
-		log.Infof("Using provider %q", pName)
+		log.Infof("Using provider %q for route %q", pName, config.Name)
 
-		break
+		if config.Mirrorlist == "" {
+			config.Mirrorlist = mirrorlistFormats[pName]
+		}
 	}
 
 	if config.Pool.PeekSizeMiBs == 0 {
@@ -82,19 +205,161 @@ func New(configFile io.Reader) (*Server, error) {
 		config.Pool.Retries = defaultRetries
 	}
 
-	return &Server{
-		provider: provider,
+	if config.Pool.SegmentThresholdMiBs > 0 {
+		if config.Pool.SegmentSizeMiBs == 0 {
+			log.Infof("Defaulting SegmentSizeMiBs to %d", defaultSegmentSizeMiBs)
+			config.Pool.SegmentSizeMiBs = defaultSegmentSizeMiBs
+		}
+
+		if config.Pool.ParallelSegments == 0 {
+			log.Infof("Defaulting ParallelSegments to %d", defaultParallelSegments)
+			config.Pool.ParallelSegments = defaultParallelSegments
+		}
+	}
+
+	if config.Pool.Redirect && config.Pool.RedirectSampleRatio == 0 {
+		log.Infof("Defaulting RedirectSampleRatio to %.2f", defaultRedirectSampleRatio)
+		config.Pool.RedirectSampleRatio = defaultRedirectSampleRatio
+	}
+
+	err := config.Pool.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var c *cache.Cache
+	if config.Cache.Dir != "" {
+		var err error
+		c, err = cache.New(config.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("creating cache: %w", err)
+		}
+	}
+
+	err = config.Stats.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	st := stats.New(config.Stats)
+	if config.Stats.StateFile != "" {
+		err := st.LoadState(config.Stats.StateFile)
+		if err != nil {
+			log.Warnf("Could not restore mirror history for route %q, starting from scratch: %v", config.Name, err)
+		}
+	}
+	metrics.RegisterStats(config.Name, st)
+
+	return &route{
+		RouteConfig: config,
+		provider:    provider,
 		pool: pool.New(
 			config.Pool,
-			stats.New(config.Stats),
+			st,
+			c,
 		),
 	}, nil
 }
 
-func (s *Server) Run(address string) error {
-	go s.pool.Run()
-	go s.pool.Feed(s.provider)
+// Run starts the pools and serves them on address. If adminAddress is not empty, administrative endpoints such as
+// /metrics and the admin API are served on it.
+// When ctx is done, Run stops accepting new connections, waits up to ShutdownGracePeriod for active transfers to
+// finish, and stops the pools before returning.
+func (s *Server) Run(ctx context.Context, address, adminAddress string) error {
+	persistCtx, stopPersisting := context.WithCancel(context.Background())
+	defer stopPersisting()
+
+	for _, r := range s.routes {
+		r.pool.Run()
+		r.pool.Feed(r.provider)
+		go r.persist(persistCtx)
+	}
+
+	var adminServer *http.Server
+	if adminAddress != "" {
+		adminServer = &http.Server{Addr: adminAddress, Handler: s.adminHandler()}
+		go func() {
+			log.Infof("Admin endpoints listening on %s", adminAddress)
+			err := adminServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("Admin server exited: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: address, Handler: s}
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("Listening on %s", address)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("Shutting down, waiting up to %s for active transfers to finish", s.gracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.gracePeriod)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Warnf("Active transfers did not finish in time: %v", err)
+		// Abort the remaining transfers, so they do not hold the pools.
+		_ = server.Close()
+	}
+
+	if adminServer != nil {
+		_ = adminServer.Close()
+	}
+
+	stopPersisting()
+	for _, r := range s.routes {
+		r.pool.Close()
+		r.saveState()
+	}
+
+	log.Infof("Shutdown complete")
+	return nil
+}
+
+// ServeHTTP routes the request to the pool of the first matching route.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rt, routed := s.route(r)
+	if rt == nil {
+		log.Warnf("No route for %s%s", r.Host, r.URL.Path)
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rt.pool.ServeHTTP(rw, routed)
+}
+
+// route returns the first route matching r, along with the request it should serve, or nil if none matches.
+func (s *Server) route(r *http.Request) (*route, *http.Request) {
+	for _, rt := range s.routes {
+		routed, matches := rt.match(r)
+		if matches {
+			return rt, routed
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Server) adminHandler() http.Handler {
+	pools := map[string]*pool.Pool{}
+	formats := map[string]string{}
+	for _, r := range s.routes {
+		pools[r.Name] = r.pool
+		formats[r.Name] = r.Mirrorlist
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/api/", admin.New(pools, formats))
 
-	log.Infof("Listening on %s", address)
-	return http.ListenAndServe(address, s.pool)
+	return mux
 }
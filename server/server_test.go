@@ -0,0 +1,32 @@
+package server_test
+
+import (
+	"roob.re/refractor/server"
+	"strings"
+	"testing"
+)
+
+func TestServer_Rejects_Shared_Cache_Dirs(t *testing.T) {
+	t.Parallel()
+
+	config := `
+routes:
+  - name: arch
+    prefix: /archlinux
+    cache:
+      dir: /var/cache/refractor
+    provider:
+      archlinux: {}
+  - name: debian
+    prefix: /debian
+    cache:
+      dir: /var/cache/refractor/
+    provider:
+      debian: {}
+`
+
+	_, err := server.New(strings.NewReader(config))
+	if err == nil || !strings.Contains(err.Error(), "same cache dir") {
+		t.Fatalf("expected an error about the shared cache dir, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHistoryAge is the time after which a mirror that has not been seen is forgotten.
+	maxHistoryAge = 7 * 24 * time.Hour
+	// recentEviction is the time during which an evicted mirror is not added back to the pool.
+	recentEviction = time.Hour
+)
+
+// MirrorHistory is the performance of a mirror across all the workers that have been bound to it.
+type MirrorHistory struct {
+	Throughput  float64   `json:"throughput"`
+	Samples     int       `json:"samples"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastEvicted time.Time `json:"lastEvicted,omitempty"`
+}
+
+// State is a snapshot of the history of mirrors, which can be persisted across restarts.
+type State struct {
+	Mirrors map[string]MirrorHistory `json:"mirrors"`
+}
+
+// mirrorOf returns the URL of the mirror a worker is bound to.
+func mirrorOf(name string) string {
+	// Workers are named after their name and the mirror they are bound to, separated by a colon.
+	_, mirror, _ := strings.Cut(name, ":")
+	return mirror
+}
+
+// record adds sample to the history of mirror. s must be locked.
+func (s *Stats) record(mirror string, sample Sample) {
+	h := s.history[mirror]
+	h.Throughput = (h.Throughput*float64(h.Samples) + sample.Throughput()) / (float64(h.Samples) + 1)
+	h.Samples++
+	if h.Samples > maxSamples {
+		h.Samples = maxSamples
+	}
+	h.LastSeen = time.Now()
+
+	s.history[mirror] = h
+}
+
+// Evicted records that a worker bound to mirror has been evicted from the pool.
+func (s *Stats) Evicted(mirror string) {
+	s.Lock()
+	defer s.Unlock()
+
+	// The mirror might not be returned by the provider again, and it will be described again if it is.
+	delete(s.metadata, mirror)
+
+	h := s.history[mirror]
+	h.LastEvicted = time.Now()
+	h.LastSeen = h.LastEvicted
+	s.history[mirror] = h
+}
+
+// RecentlyEvicted returns whether a worker bound to mirror has been evicted in the last hour, either since the pool
+// started or before it was restarted.
+func (s *Stats) RecentlyEvicted(mirror string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.history[mirror].recentlyEvicted()
+}
+
+func (h MirrorHistory) recentlyEvicted() bool {
+	return time.Since(h.LastEvicted) < recentEviction
+}
+
+// Preferred returns up to n mirrors with the best historical throughput, from best to worst. Mirrors evicted recently
+// are not returned.
+func (s *Stats) Preferred(n int) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	mirrors := make([]string, 0, len(s.history))
+	for mirror, h := range s.history {
+		if h.Samples == 0 || h.recentlyEvicted() {
+			continue
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	slices.SortFunc(mirrors, func(a, b string) bool {
+		return s.history[a].Throughput > s.history[b].Throughput
+	})
+
+	if len(mirrors) > n {
+		mirrors = mirrors[:n]
+	}
+
+	return mirrors
+}
+
+// Snapshot returns the current history of mirrors.
+func (s *Stats) Snapshot() State {
+	s.RLock()
+	defer s.RUnlock()
+
+	state := State{Mirrors: make(map[string]MirrorHistory, len(s.history))}
+	for mirror, h := range s.history {
+		state.Mirrors[mirror] = h
+	}
+
+	return state
+}
+
+// Restore replaces the history of mirrors with the one in state, forgetting mirrors that have not been seen for a long
+// time.
+func (s *Stats) Restore(state State) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.history = map[string]MirrorHistory{}
+	for mirror, h := range state.Mirrors {
+		if time.Since(h.LastSeen) > maxHistoryAge {
+			continue
+		}
+
+		s.history[mirror] = h
+	}
+}
+
+// SaveState writes a snapshot of the history of mirrors to path, atomically replacing it if it exists.
+func (s *Stats) SaveState(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = json.NewEncoder(tmp).Encode(s.Snapshot())
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("encoding state: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// LoadState restores the history of mirrors from path. A missing file is not an error.
+func (s *Stats) LoadState(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Infof("State file %s does not exist yet, starting from scratch", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening state: %w", err)
+	}
+	defer file.Close()
+
+	state := State{}
+	err = json.NewDecoder(file).Decode(&state)
+	if err != nil {
+		return fmt.Errorf("decoding state: %w", err)
+	}
+
+	s.Restore(state)
+	log.Infof("Restored history of %d mirrors from %s", len(s.Snapshot().Mirrors), path)
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package stats_test
+
+import (
+	"path/filepath"
+	"roob.re/refractor/stats"
+	"testing"
+	"time"
+)
+
+func TestStats_Persists_History(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	st := stats.New(stats.Config{})
+	st.Update("fast-worker:http://fast.mirror/", stats.Sample{Bytes: 10 * 1024 * 1024, Duration: time.Second})
+	st.Update("slow-worker:http://slow.mirror/", stats.Sample{Bytes: 1024 * 1024, Duration: time.Second})
+	st.Update("evicted-worker:http://evicted.mirror/", stats.Sample{Bytes: 20 * 1024 * 1024, Duration: time.Second})
+	st.Evicted("http://evicted.mirror/")
+
+	err := st.SaveState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := stats.New(stats.Config{})
+	err = restored.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(restored.Snapshot().Mirrors); n != 3 {
+		t.Fatalf("expected 3 mirrors to be restored, got %d", n)
+	}
+
+	if !restored.RecentlyEvicted("http://evicted.mirror/") || restored.RecentlyEvicted("http://fast.mirror/") {
+		t.Fatalf("expected only the evicted mirror to be recently evicted")
+	}
+
+	preferred := restored.Preferred(5)
+	if len(preferred) != 2 || preferred[0] != "http://fast.mirror/" || preferred[1] != "http://slow.mirror/" {
+		t.Fatalf("unexpected preferred mirrors %v", preferred)
+	}
+}
+
+func TestStats_Loads_Missing_State(t *testing.T) {
+	t.Parallel()
+
+	err := stats.New(stats.Config{}).LoadState(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,246 @@
+package stats
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"math"
+)
+
+// Policies that can be selected in Config.Policy.
+const (
+	// PolicyAverage averages the last few samples of each worker, and evicts workers outside the top NumTopWorkers.
+	PolicyAverage = "average"
+	// PolicyEWMA is like PolicyAverage, but weights samples with an exponentially decaying weight so the most recent
+	// ones count the most. The weight of a sample halves every EWMAHalfLife samples.
+	PolicyEWMA = "ewma"
+	// PolicyPercentile takes the median of the last few samples of each worker, which is not skewed by outliers, and
+	// evicts workers whose score is below EvictPercentile of the ranked workers.
+	PolicyPercentile = "percentile"
+	// PolicyUCB treats choosing mirrors as a multi-armed bandit. Workers are kept while the upper confidence bound of
+	// their score is within the top NumTopWorkers, so workers with few samples get a chance to prove themselves before
+	// being evicted. Exploration controls how wide the bound is.
+	PolicyUCB = "ucb"
+)
+
+// Policy decides how the throughput samples of a worker are aggregated, and which workers perform well enough to stay
+// in the pool.
+type Policy interface {
+	// NewEstimator returns an empty estimator for the samples of a worker.
+	NewEstimator() Estimator
+	// GoodPerformer returns whether the worker at position in ranking, which is sorted from best to worst, performs
+	// well enough to stay in the pool.
+	GoodPerformer(ranking []Entry, position int) bool
+}
+
+// Estimator aggregates the throughput samples of a worker.
+type Estimator interface {
+	Add(throughput float64)
+	Throughput() float64
+	// Samples returns the number of samples the estimate is based on.
+	Samples() int
+}
+
+// newPolicy returns the policy selected in c, which must have its defaults set.
+func newPolicy(c Config) (Policy, error) {
+	top := topWorkers{n: c.NumTopWorkers}
+
+	switch c.Policy {
+	case PolicyAverage:
+		return averagePolicy{topWorkers: top}, nil
+	case PolicyEWMA:
+		return ewmaPolicy{topWorkers: top, halfLife: c.EWMAHalfLife}, nil
+	case PolicyPercentile:
+		return percentilePolicy{percentile: c.EvictPercentile}, nil
+	case PolicyUCB:
+		return ucbPolicy{topWorkers: top, exploration: c.Exploration}, nil
+	default:
+		return nil, fmt.Errorf("unknown stats policy %q", c.Policy)
+	}
+}
+
+// topWorkers keeps the best n workers in the ranking.
+type topWorkers struct {
+	n int
+}
+
+func (t topWorkers) GoodPerformer(_ []Entry, position int) bool {
+	return position < t.n
+}
+
+type averagePolicy struct {
+	topWorkers
+}
+
+func (averagePolicy) NewEstimator() Estimator {
+	return &average{}
+}
+
+// average is the average of the last maxSamples samples.
+type average struct {
+	samples int
+	average float64
+}
+
+func (a *average) Add(throughput float64) {
+	a.average = (a.average*float64(a.samples) + throughput) / (float64(a.samples) + 1)
+	a.samples++
+	if a.samples > maxSamples {
+		// As time passes, mirrors that performed very well in the past might stack an indefinitely large amount
+		// of samples, which might bias how the mirror is performing now. To avoid this, the number of samples taken
+		// into account is capped at maxSamples.
+		a.samples = maxSamples
+	}
+}
+
+func (a *average) Throughput() float64 {
+	return a.average
+}
+
+func (a *average) Samples() int {
+	return a.samples
+}
+
+type ewmaPolicy struct {
+	topWorkers
+	halfLife float64
+}
+
+func (p ewmaPolicy) NewEstimator() Estimator {
+	return &ewma{alpha: 1 - math.Pow(0.5, 1/p.halfLife)}
+}
+
+// ewma is an exponentially weighted moving average, where each new sample has a weight of alpha.
+type ewma struct {
+	alpha   float64
+	samples int
+	value   float64
+}
+
+func (e *ewma) Add(throughput float64) {
+	if e.samples == 0 {
+		e.value = throughput
+	} else {
+		e.value += e.alpha * (throughput - e.value)
+	}
+
+	e.samples++
+}
+
+func (e *ewma) Throughput() float64 {
+	return e.value
+}
+
+func (e *ewma) Samples() int {
+	return e.samples
+}
+
+type percentilePolicy struct {
+	percentile float64
+}
+
+func (percentilePolicy) NewEstimator() Estimator {
+	return &median{}
+}
+
+func (p percentilePolicy) GoodPerformer(ranking []Entry, position int) bool {
+	scores := make([]float64, 0, len(ranking))
+	for _, entry := range ranking {
+		scores = append(scores, entry.Score)
+	}
+
+	return ranking[position].Score >= percentile(scores, p.percentile)
+}
+
+// median is the median of the last maxSamples samples.
+type median struct {
+	window []float64
+}
+
+func (m *median) Add(throughput float64) {
+	m.window = append(m.window, throughput)
+	if len(m.window) > maxSamples {
+		m.window = m.window[1:]
+	}
+}
+
+func (m *median) Throughput() float64 {
+	return percentile(m.window, 50)
+}
+
+func (m *median) Samples() int {
+	return len(m.window)
+}
+
+// percentile returns the p-th percentile of values, interpolating between the closest ones. It returns 0 if values is
+// empty.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+type ucbPolicy struct {
+	topWorkers
+	exploration float64
+}
+
+func (ucbPolicy) NewEstimator() Estimator {
+	return &pulls{}
+}
+
+func (p ucbPolicy) GoodPerformer(ranking []Entry, position int) bool {
+	if p.topWorkers.GoodPerformer(ranking, position) {
+		return true
+	}
+
+	entry := ranking[position]
+	if entry.Samples == 0 {
+		// Workers ranked by latency might not have any throughput sample yet, which makes their bound infinite.
+		return true
+	}
+
+	total := 0
+	for _, entry := range ranking {
+		total += entry.Samples
+	}
+
+	// Scores can be throughputs or (negative) times depending on the scoring function, so the bound is scaled to the
+	// spread of the scores in the ranking. With a single sample in total, there is nothing to explore yet.
+	bound := entry.Score
+	if total > 1 {
+		spread := ranking[0].Score - ranking[len(ranking)-1].Score
+		bound += p.exploration * spread * math.Sqrt(2*math.Log(float64(total))/float64(entry.Samples))
+	}
+
+	cutoff := ranking[0]
+	if p.n > 0 {
+		cutoff = ranking[p.n-1]
+	}
+
+	return bound >= cutoff.Score
+}
+
+// pulls is an average that also counts every sample it has been given, as the number of times a worker has been
+// tried matters for the confidence bound.
+type pulls struct {
+	average
+	pulls int
+}
+
+func (p *pulls) Add(throughput float64) {
+	p.average.Add(throughput)
+	p.pulls++
+}
+
+func (p *pulls) Samples() int {
+	return p.pulls
+}
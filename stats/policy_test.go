@@ -0,0 +1,116 @@
+package stats_test
+
+import (
+	"roob.re/refractor/stats"
+	"testing"
+	"time"
+)
+
+// mibs returns a sample with a throughput of n MiB/s.
+func mibs(n float64) stats.Sample {
+	return stats.Sample{Bytes: int64(n * 1024 * 1024), Duration: time.Second}
+}
+
+func TestStats_Aggregates_Samples_By_Policy(t *testing.T) {
+	t.Parallel()
+
+	// A mirror that was fast for a while, then slowed down, with an outlier in between.
+	samples := []float64{10, 10, 10, 10, 100, 10, 1, 1, 1, 1}
+
+	for _, tc := range []struct {
+		policy   string
+		min, max float64
+	}{
+		// The average is dragged by the outlier and still remembers the good times.
+		{policy: stats.PolicyAverage, min: 15, max: 16},
+		// The EWMA forgets the good times faster.
+		{policy: stats.PolicyEWMA, min: 5, max: 10},
+		// The median ignores the outlier.
+		{policy: stats.PolicyPercentile, min: 10, max: 10},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+
+			st := stats.New(stats.Config{Policy: tc.policy, EWMAHalfLife: 2})
+			for _, sample := range samples {
+				st.Update("worker:http://mirror/", mibs(sample))
+			}
+
+			throughput := st.Ranking()[0].Throughput / 1024 / 1024
+			if throughput < tc.min || throughput > tc.max {
+				t.Fatalf("expected throughput between %.0f and %.0f MiB/s, got %.2f", tc.min, tc.max, throughput)
+			}
+		})
+	}
+}
+
+func TestStats_Evicts_By_Policy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		policy string
+		good   bool
+	}{
+		{policy: stats.PolicyAverage, good: false},
+		{policy: stats.PolicyPercentile, good: false},
+		// The newcomer has a single sample, so it is given the benefit of the doubt.
+		{policy: stats.PolicyUCB, good: true},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+
+			st := stats.New(stats.Config{
+				Policy:             tc.policy,
+				NumWorkers:         4,
+				NumTopWorkers:      2,
+				GoodThroughputMiBs: 1000,
+				EvictPercentile:    50,
+			})
+			for i := 0; i < 20; i++ {
+				st.Update("a:http://a.mirror/", mibs(10))
+				st.Update("b:http://b.mirror/", mibs(8))
+				st.Update("c:http://c.mirror/", mibs(6))
+			}
+			st.Update("newcomer:http://newcomer.mirror/", mibs(5))
+
+			if good := st.GoodPerformer("newcomer:http://newcomer.mirror/"); good != tc.good {
+				t.Fatalf("expected GoodPerformer to be %v", tc.good)
+			}
+
+			if !st.GoodPerformer("a:http://a.mirror/") {
+				t.Fatalf("best worker should never be evicted")
+			}
+		})
+	}
+}
+
+func TestStats_Keeps_Unsampled_Workers_With_UCB(t *testing.T) {
+	t.Parallel()
+
+	st := stats.New(stats.Config{
+		Policy:        stats.PolicyUCB,
+		Scoring:       stats.ScoringLatency,
+		NumWorkers:    4,
+		NumTopWorkers: 2,
+	})
+
+	// Samples too small to measure throughput, which still rank workers by their latency.
+	for i, name := range []string{"a:http://a.mirror/", "b:http://b.mirror/", "c:http://c.mirror/"} {
+		st.Update(name, stats.Sample{Bytes: 1, Duration: time.Millisecond, TTFB: time.Duration(i+1) * time.Millisecond})
+	}
+	st.Update("slow:http://slow.mirror/", stats.Sample{Bytes: 1, Duration: time.Second / 2, TTFB: time.Second / 2})
+
+	if !st.GoodPerformer("slow:http://slow.mirror/") {
+		t.Fatalf("workers without throughput samples should not be evicted")
+	}
+}
+
+func TestConfig_Rejects_Unknown_Policy(t *testing.T) {
+	t.Parallel()
+
+	if err := (stats.Config{Policy: "random"}).Validate(); err == nil {
+		t.Fatalf("expected unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,54 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+// Scoring functions used to rank workers, see Config.Scoring.
+const (
+	// ScoringThroughput ranks workers by their steady-state throughput, ignoring latency.
+	ScoringThroughput = "throughput"
+	// ScoringLatency ranks workers by their time to first byte, ignoring throughput.
+	ScoringLatency = "latency"
+	// ScoringTransferTime ranks workers by the estimated time it would take them to transfer a file of
+	// Config.ScoringSizeKiBs, accounting for both their latency and their throughput.
+	ScoringTransferTime = "transferTime"
+)
+
+// validateScoring returns an error if scoring is not one of the known scoring functions.
+func validateScoring(scoring string) error {
+	switch scoring {
+	case ScoringThroughput, ScoringLatency, ScoringTransferTime:
+		return nil
+	default:
+		return fmt.Errorf("unknown scoring function %q", scoring)
+	}
+}
+
+// score returns the score of e under the configured scoring function, and whether e has the samples needed to compute
+// it. Higher scores are better.
+func (s *Stats) score(e Entry) (float64, bool) {
+	switch s.Scoring {
+	case ScoringLatency:
+		if e.Latency == 0 {
+			return 0, false
+		}
+
+		return -e.Latency.Seconds(), true
+	case ScoringTransferTime:
+		if e.Throughput == 0 {
+			return 0, false
+		}
+
+		// Workers whose latency has not been measured yet are assumed to have none.
+		transfer := time.Duration(s.ScoringSizeKiBs * 1024 / e.Throughput * float64(time.Second))
+		return -(e.Latency + transfer).Seconds(), true
+	default:
+		if e.Throughput == 0 {
+			return 0, false
+		}
+
+		return e.Throughput, true
+	}
+}
@@ -0,0 +1,56 @@
+package stats_test
+
+import (
+	"roob.re/refractor/stats"
+	"testing"
+	"time"
+)
+
+func TestStats_Ranks_By_Scoring(t *testing.T) {
+	t.Parallel()
+
+	// The bulk worker transfers fast once it starts, but takes long to start. The snappy worker is the opposite.
+	samples := map[string]stats.Sample{
+		"bulk:http://bulk.mirror/":     {Bytes: 20 * 1024 * 1024, Duration: 2 * time.Second, TTFB: time.Second},
+		"snappy:http://snappy.mirror/": {Bytes: 2 * 1024 * 1024, Duration: 1050 * time.Millisecond, TTFB: 50 * time.Millisecond},
+	}
+
+	for _, tc := range []struct {
+		scoring string
+		sizeKiB float64
+		best    string
+	}{
+		{scoring: stats.ScoringThroughput, best: "bulk:http://bulk.mirror/"},
+		{scoring: stats.ScoringLatency, best: "snappy:http://snappy.mirror/"},
+		{scoring: stats.ScoringTransferTime, sizeKiB: 64, best: "snappy:http://snappy.mirror/"},
+		{scoring: stats.ScoringTransferTime, sizeKiB: 100 * 1024, best: "bulk:http://bulk.mirror/"},
+	} {
+		tc := tc
+		t.Run(tc.scoring, func(t *testing.T) {
+			t.Parallel()
+
+			st := stats.New(stats.Config{Scoring: tc.scoring, ScoringSizeKiBs: tc.sizeKiB})
+			for name, sample := range samples {
+				st.Update(name, sample)
+			}
+
+			ranking := st.Ranking()
+			if len(ranking) != 2 {
+				t.Fatalf("expected 2 ranked workers, got %d", len(ranking))
+			}
+
+			if ranking[0].Name != tc.best {
+				t.Fatalf("expected %s to be ranked first, got %v", tc.best, ranking)
+			}
+		})
+	}
+}
+
+func TestSample_Excludes_TTFB_From_Throughput(t *testing.T) {
+	t.Parallel()
+
+	sample := stats.Sample{Bytes: 1024 * 1024, Duration: 2 * time.Second, TTFB: time.Second}
+	if throughput := sample.Throughput(); throughput != 1024*1024 {
+		t.Fatalf("expected 1 MiB/s, got %.0f B/s", throughput)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
+	"roob.re/refractor/provider/types"
 	"sync"
 	"time"
 )
@@ -19,7 +20,11 @@ const (
 type Stats struct {
 	Config
 	sync.RWMutex
+	policy     Policy
 	workers    map[string]workerEntry
+	history    map[string]MirrorHistory
+	metadata   map[string]types.Mirror
+	pinned     map[string]bool
 	lastReport time.Time
 }
 
@@ -28,6 +33,26 @@ type Config struct {
 	NumTopWorkers int `yaml:"topWorkers"`
 
 	GoodThroughputMiBs float64 `yaml:"goodThroughputMiBs"`
+
+	// Policy selects how samples are aggregated and which workers are evicted for their performance, one of the
+	// Policy* constants. Defaults to PolicyAverage.
+	Policy string `yaml:"policy"`
+	// EWMAHalfLife is the number of samples after which the weight of a sample halves, for PolicyEWMA.
+	EWMAHalfLife float64 `yaml:"ewmaHalfLife"`
+	// EvictPercentile is the percentile of the ranking below which workers are evicted, for PolicyPercentile.
+	EvictPercentile float64 `yaml:"evictPercentile"`
+	// Exploration is how much workers with few samples are favored over known ones, for PolicyUCB.
+	Exploration float64 `yaml:"exploration"`
+
+	// Scoring is the function used to rank workers, one of the Scoring* constants. Defaults to ScoringThroughput.
+	Scoring string `yaml:"scoring"`
+	// ScoringSizeKiBs is the size of the file whose transfer time is estimated by ScoringTransferTime.
+	ScoringSizeKiBs float64 `yaml:"scoringSizeKiBs"`
+
+	// StateFile, if not empty, is the path where the history of mirrors is persisted across restarts.
+	StateFile string `yaml:"stateFile"`
+	// StateInterval is how often the history of mirrors is written to StateFile, besides on shutdown.
+	StateInterval time.Duration `yaml:"stateInterval"`
 }
 
 func (c Config) WithDefaults() Config {
@@ -43,39 +68,177 @@ func (c Config) WithDefaults() Config {
 		c.GoodThroughputMiBs = 10
 	}
 
+	if c.Policy == "" {
+		c.Policy = PolicyAverage
+	}
+
+	if c.EWMAHalfLife == 0 {
+		c.EWMAHalfLife = 5
+	}
+
+	if c.EvictPercentile == 0 {
+		c.EvictPercentile = 25
+	}
+
+	if c.Exploration == 0 {
+		c.Exploration = 1
+	}
+
+	if c.Scoring == "" {
+		c.Scoring = ScoringThroughput
+	}
+
+	if c.ScoringSizeKiBs == 0 {
+		c.ScoringSizeKiBs = 1024
+	}
+
+	if c.StateInterval == 0 {
+		c.StateInterval = 5 * time.Minute
+	}
+
 	return c
 }
 
+// Validate returns an error if c selects an unknown policy or scoring function.
+func (c Config) Validate() error {
+	c = c.WithDefaults()
+
+	err := validateScoring(c.Scoring)
+	if err != nil {
+		return err
+	}
+
+	_, err = newPolicy(c)
+	return err
+}
+
 type Sample struct {
 	Bytes    int64
 	Duration time.Duration
+	// TTFB is the time it took for the first byte of the body to arrive, which is part of Duration. It is zero if the
+	// body was empty or was not read.
+	TTFB time.Duration
 }
 
 func (s Sample) String() string {
-	return fmt.Sprintf("%.2f MiB/s", s.Throughput()/1024/1024)
+	if s.TTFB == 0 {
+		return fmt.Sprintf("%.2f MiB/s", s.Throughput()/1024/1024)
+	}
+
+	return fmt.Sprintf("%.2f MiB/s, %v TTFB", s.Throughput()/1024/1024, s.TTFB.Round(time.Millisecond))
 }
 
+// Throughput returns the steady-state transfer rate of the sample, once the first byte arrived.
 func (s Sample) Throughput() float64 {
-	return float64(s.Bytes) / s.Duration.Seconds()
+	return float64(s.Bytes) / s.transfer().Seconds()
+}
+
+// transfer returns the time spent transferring the body, after the first byte arrived.
+func (s Sample) transfer() time.Duration {
+	if s.TTFB <= 0 || s.TTFB >= s.Duration {
+		return s.Duration
+	}
+
+	return s.Duration - s.TTFB
 }
 
 type workerEntry struct {
-	samples int
-	average float64
+	// throughput is nil until the first throughput sample is recorded.
+	throughput Estimator
+	// latencySamples and latency are the number of samples and the average of their TTFB, in seconds.
+	latencySamples int
+	latency        float64
 }
 
-type namedEntry struct {
-	name       string
-	throughput float64
+// Entry is the position of a worker in the ranking.
+type Entry struct {
+	Name string
+	// Mirror is the URL of the mirror the worker is bound to.
+	Mirror     string
+	Throughput float64
+	Samples    int
+	// Latency is the average time to first byte of the worker, or zero if it has not been measured yet.
+	Latency time.Duration
+	// Score is the value given to the worker by the configured scoring function. Higher is better.
+	Score float64
+	// Metadata is what the provider knows about the mirror of the worker.
+	Metadata types.Mirror
 }
 
 func New(c Config) *Stats {
+	c = c.WithDefaults()
+
+	policy, err := newPolicy(c)
+	if err != nil {
+		log.Warnf("%v, using %s", err, PolicyAverage)
+		policy = averagePolicy{topWorkers: topWorkers{n: c.NumTopWorkers}}
+	}
+
 	return &Stats{
-		Config:  c.WithDefaults(),
-		workers: map[string]workerEntry{},
+		Config:   c,
+		policy:   policy,
+		workers:  map[string]workerEntry{},
+		history:  map[string]MirrorHistory{},
+		metadata: map[string]types.Mirror{},
+		pinned:   map[string]bool{},
 	}
 }
 
+// Pin marks mirror as a known good one, whose workers should never be evicted for their performance.
+func (s *Stats) Pin(mirror string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pinned[mirror] = true
+}
+
+// Unpin removes mirror from the list of pinned mirrors.
+func (s *Stats) Unpin(mirror string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.pinned, mirror)
+}
+
+// Pinned returns whether mirror has been pinned.
+func (s *Stats) Pinned(mirror string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.pinned[mirror]
+}
+
+// Pins returns the list of pinned mirrors.
+func (s *Stats) Pins() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	pins := make([]string, 0, len(s.pinned))
+	for mirror := range s.pinned {
+		pins = append(pins, mirror)
+	}
+	slices.Sort(pins)
+
+	return pins
+}
+
+// Describe records what the provider knows about a mirror, which is then included in the entries of its workers.
+func (s *Stats) Describe(mirror types.Mirror) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.metadata[mirror.URL] = mirror
+}
+
+// Metadata returns what the provider knows about mirror, if it has been described.
+func (s *Stats) Metadata(mirror string) (types.Mirror, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	meta, found := s.metadata[mirror]
+	return meta, found
+}
+
 func (s *Stats) Remove(name string) {
 	s.Lock()
 	defer s.Unlock()
@@ -84,13 +247,17 @@ func (s *Stats) Remove(name string) {
 }
 
 func (s *Stats) Update(name string, sample Sample) {
+	if sample.TTFB > 0 {
+		s.updateLatency(name, sample.TTFB)
+	}
+
 	if sample.Bytes < minSampleBytes && sample.Duration < minDurationForMinBytes {
 		log.Infof("Dropping sample for %s, not enough bytes to measure (%d)", name, sample.Bytes)
 		return
 	}
 
-	if sample.Duration < minSampleDuration {
-		log.Infof("Dropping sample for %s, not transaction too short to measure (%v)", name, sample.Duration)
+	if sample.transfer() < minSampleDuration {
+		log.Infof("Dropping sample for %s, not transaction too short to measure (%v)", name, sample.transfer())
 		return
 	}
 
@@ -104,13 +271,26 @@ func (s *Stats) Update(name string, sample Sample) {
 	defer s.Unlock()
 
 	w := s.workers[name]
-	w.average = (w.average*float64(w.samples) + sample.Throughput()) / (float64(w.samples) + 1)
-	w.samples++
-	if w.samples > maxSamples {
-		// As time passes, mirrors that performed very well in the past might stack an indefinitely large amount
-		// of samples, which might bias how the mirror is performing now. To avoid this, the number of samples taken
-		// into account is capped at maxSamples.
-		w.samples = maxSamples
+	if w.throughput == nil {
+		w.throughput = s.policy.NewEstimator()
+	}
+	w.throughput.Add(sample.Throughput())
+
+	s.workers[name] = w
+	s.record(mirrorOf(name), sample)
+}
+
+// updateLatency adds a TTFB sample to the average latency of a worker. Latency is recorded even for samples too small
+// to measure throughput, as those are the ones where it matters the most.
+func (s *Stats) updateLatency(name string, ttfb time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	w := s.workers[name]
+	w.latency = (w.latency*float64(w.latencySamples) + ttfb.Seconds()) / (float64(w.latencySamples) + 1)
+	w.latencySamples++
+	if w.latencySamples > maxSamples {
+		w.latencySamples = maxSamples
 	}
 
 	s.workers[name] = w
@@ -124,8 +304,8 @@ func (s *Stats) GoodPerformer(name string) bool {
 		return true
 	}
 
-	position := slices.IndexFunc(entries, func(entry namedEntry) bool {
-		return entry.name == name
+	position := slices.IndexFunc(entries, func(entry Entry) bool {
+		return entry.Name == name
 	})
 
 	if position == -1 {
@@ -135,13 +315,12 @@ func (s *Stats) GoodPerformer(name string) bool {
 
 	log.Debugf("Worker %s is in position %d/%d", name, position+1, len(s.workers))
 
-	if entries[position].throughput > s.GoodThroughputMiBs*1024*1024 {
+	if entries[position].Throughput > s.GoodThroughputMiBs*1024*1024 {
 		log.Debugf("Worker %s has an absolutely good throughput", name)
 		return true
 	}
 
-	// We're good performers if we're earlier than the last two positions
-	return position < s.NumTopWorkers
+	return s.policy.GoodPerformer(entries, position)
 }
 
 func (s *Stats) report() {
@@ -152,7 +331,8 @@ func (s *Stats) report() {
 	list := s.workerList()
 	statsStr := "Worker stats:"
 	for _, worker := range list {
-		statsStr += fmt.Sprintf("\n%.2fMiB/s\t%s", worker.throughput/1024/1024, worker.name)
+		statsStr += fmt.Sprintf("\n%.2fMiB/s\t%v\t%s\t%s",
+			worker.Throughput/1024/1024, worker.Latency.Round(time.Millisecond), worker.Name, worker.Metadata.Country)
 	}
 	log.Info(statsStr)
 }
@@ -169,26 +349,42 @@ func (s *Stats) shouldReport() bool {
 	return true
 }
 
-func (s *Stats) workerList() []namedEntry {
+// Ranking returns the ranked workers, sorted from best to worst.
+func (s *Stats) Ranking() []Entry {
+	return s.workerList()
+}
+
+func (s *Stats) workerList() []Entry {
 	s.RLock()
 	defer s.RUnlock()
 
-	entries := make([]namedEntry, 0, len(s.workers))
+	entries := make([]Entry, 0, len(s.workers))
 
 	for wName, entry := range s.workers {
-		if entry.average == 0 {
+		mirror := mirrorOf(wName)
+		e := Entry{
+			Name:     wName,
+			Mirror:   mirror,
+			Latency:  time.Duration(entry.latency * float64(time.Second)),
+			Metadata: s.metadata[mirror],
+		}
+		if entry.throughput != nil {
+			e.Throughput = entry.throughput.Throughput()
+			e.Samples = entry.throughput.Samples()
+		}
+
+		var scored bool
+		e.Score, scored = s.score(e)
+		if !scored {
 			continue
 		}
 
-		entries = append(entries, namedEntry{
-			name:       wName,
-			throughput: entry.average,
-		})
+		entries = append(entries, e)
 	}
 
-	slices.SortFunc(entries, func(a, b namedEntry) bool {
-		// Less func is inverted to sort in descending order (from best to worst throughput)
-		return a.throughput > b.throughput
+	slices.SortFunc(entries, func(a, b Entry) bool {
+		// Less func is inverted to sort in descending order (from best to worst score)
+		return a.Score > b.Score
 	})
 
 	return entries
@@ -3,8 +3,11 @@ package worker
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"roob.re/refractor/client"
+	"roob.re/refractor/metrics"
 	"roob.re/refractor/stats"
+	"sync"
 	"time"
 )
 
@@ -12,22 +15,84 @@ type Worker struct {
 	Name   string
 	Stats  *stats.Stats
 	Client *client.Client
+	// Evict, if not nil, makes the worker leave the pool when it is closed.
+	Evict <-chan struct{}
+	// Direct, if not nil, receives requests that must be served by this worker in particular.
+	Direct <-chan client.Request
+	// Stop, if not nil, makes the worker return without error when it is closed, as the pool is shutting down.
+	Stop    <-chan struct{}
+	Metrics *metrics.Route
+	// OnSample, if not nil, is called with every sample recorded for this worker.
+	OnSample func(sample stats.Sample)
+}
+
+// Eviction is the error returned by Work when the worker leaves the pool, other than when it is stopped.
+type Eviction struct {
+	// Reason is one of the metrics.Eviction* reasons.
+	Reason string
+	Err    error
+}
+
+func (e *Eviction) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Eviction) Unwrap() error {
+	return e.Err
 }
 
 func (w Worker) String() string {
 	return fmt.Sprintf("%s:%s", w.Name, w.Client.String())
 }
 
+// Work serves requests until the worker leaves the pool, returning the reason why it did. It returns nil if it was
+// stopped.
 func (w Worker) Work(requests chan client.Request) error {
 	log.Debugf("Starting worker %s", w.String())
 
-	for req := range requests {
-		if !w.Stats.GoodPerformer(w.String()) {
+	// failures receives errors that occurred while the body of a response was being read.
+	failures := make(chan error, 1)
+
+	for {
+		var req client.Request
+		select {
+		case <-w.Stop:
+			log.Debugf("Stopping worker %s", w.String())
+			return nil
+		case <-w.Evict:
+			return w.evicted(metrics.EvictionManual, "worker %s was evicted", w.String())
+		case r, ok := <-requests:
+			if !ok {
+				return fmt.Errorf("request channel closed")
+			}
+			req = r
+		case r := <-w.Direct:
+			req = r
+		}
+
+		if req.Context.Err() != nil {
+			log.Debugf("Dropping request for %s, client went away while it was queued", req.Path)
+			continue
+		}
+
+		select {
+		case err := <-failures:
 			go func() {
 				requests <- req
 			}()
 
-			return fmt.Errorf("worker %s is not a good performer, evicting and requeuing request", w.String())
+			return w.evicted(metrics.EvictionTransfer,
+				"worker %s failed to transfer a response, sacrificing: %v", w.String(), err)
+		default:
+		}
+
+		if !w.Stats.Pinned(w.Client.String()) && !w.Stats.GoodPerformer(w.String()) {
+			go func() {
+				requests <- req
+			}()
+
+			return w.evicted(metrics.EvictionPerformance,
+				"worker %s is not a good performer, evicting and requeuing request", w.String())
 		}
 
 		log.Infof("Requesting %s:%s", w.Name, w.Client.URL(req.Path))
@@ -36,25 +101,102 @@ func (w Worker) Work(requests chan client.Request) error {
 		response := w.Client.Do(req)
 		response.Worker = w.String()
 
+		if response.Error != nil && req.Context.Err() != nil {
+			// The client went away, which is not the mirror's fault.
+			log.Debugf("Request for %s cancelled by the client: %v", req.Path, response.Error)
+			w.respond(req, response)
+			continue
+		}
+
 		if response.Error != nil {
 			go func() {
 				requests <- req
 			}()
 
-			return fmt.Errorf("worker %s returned error for %s, sacrificing: %v", w.String(), req.Path, response.Error)
+			return w.evicted(metrics.EvictionError,
+				"worker %s returned error for %s, sacrificing: %v", w.String(), req.Path, response.Error)
 		}
 
-		response.Done = func(written int64) {
+		// The body is first read by the pool to peek it, so this measures the time until the peek starts to get data.
+		body := &firstByteReader{ReadCloser: response.HTTPResponse.Body}
+		response.HTTPResponse.Body = body
+
+		response.Done = func(read int64, err error) {
+			if req.Context.Err() != nil {
+				// Partial transfers interrupted by the client do not tell anything about the mirror.
+				log.Debugf("Not recording sample for %s:%s, cancelled by the client", w.Name, w.Client.URL(req.Path))
+				return
+			}
+
+			if err != nil {
+				select {
+				case failures <- err:
+				default:
+				}
+			}
+
 			sample := stats.Sample{
-				Bytes:    written,
+				Bytes:    read,
 				Duration: time.Since(start),
+				TTFB:     body.since(start),
 			}
 			log.Infof("%s %s:%s", sample.String(), w.Name, w.Client.URL(req.Path))
 			go w.Stats.Update(w.String(), sample)
+			if w.OnSample != nil {
+				w.OnSample(sample)
+			}
 		}
 
-		req.ResponseChan <- response
+		w.respond(req, response)
 	}
+}
+
+// firstByteReader records the time at which the first byte of a body was read.
+type firstByteReader struct {
+	io.ReadCloser
+	mutex sync.Mutex
+	first time.Time
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.mutex.Lock()
+		if r.first.IsZero() {
+			r.first = time.Now()
+		}
+		r.mutex.Unlock()
+	}
+
+	return n, err
+}
+
+// since returns the time elapsed between start and the first byte being read, or zero if none has been read.
+func (r *firstByteReader) since(start time.Time) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.first.IsZero() {
+		return 0
+	}
+
+	return r.first.Sub(start)
+}
+
+// respond sends response back to the pool, unless the client that originated req went away. In that case, the body
+// of the response is closed.
+func (w Worker) respond(req client.Request, response client.Response) {
+	select {
+	case req.ResponseChan <- response:
+	case <-req.Context.Done():
+		if response.HTTPResponse != nil {
+			response.HTTPResponse.Body.Close()
+		}
+	}
+}
 
-	return fmt.Errorf("request channel closed")
+// evicted records that the worker is leaving the pool for the given reason, and returns an Eviction error.
+func (w Worker) evicted(reason string, format string, args ...interface{}) error {
+	w.Metrics.Evictions.WithLabelValues(reason).Inc()
+	return &Eviction{Reason: reason, Err: fmt.Errorf(format, args...)}
 }